@@ -1,11 +1,13 @@
 package main
 
 import (
-    "bytes"
+    "context"
     "encoding/base64"
     "fmt"
+    "math"
     "os"
     "path/filepath"
+    "runtime"
     "strings"
     "time"
 
@@ -13,7 +15,7 @@ import (
     "github.com/pkg/errors"
     "github.com/urfave/cli"
     gosync "github.com/Redundancy/go-sync"
-    "github.com/Redundancy/go-sync/filechecksum"
+    "pcsync/pcsync"
 )
 
 func init() {
@@ -23,6 +25,8 @@ func init() {
             Name:      "build",
             ShortName: "b",
             Usage:     "build a .pcsync file for a file",
+            Description: `Build an index for a file. Use "-" to read the file from stdin, e.g. "xz -dc image.xz | pcsync build --output image.pcsync -".
+Stdin and pipes are hashed as a stream, and the checksums are written straight to the output.`,
             Action:    Build,
             Flags: []cli.Flag{
                 cli.IntFlag{
@@ -38,6 +42,25 @@ func init() {
                     Name:  "output-dir",
                     Usage: "output directory specified",
                 },
+                cli.StringFlag{
+                    Name:  "output",
+                    Usage: "output file path. required when reading from stdin",
+                },
+                cli.IntFlag{
+                    Name:  "p",
+                    Value: runtime.NumCPU(),
+                    Usage: "The number of sections of the file to hash concurrently",
+                },
+                cli.StringFlag{
+                    Name:  "strong-hash",
+                    Value: pcsync.DefaultStrongHash.String(),
+                    Usage: "The strong block checksum algorithm (md5, sha256 or blake2b)",
+                },
+                cli.StringFlag{
+                    Name:  "chunking",
+                    Value: pcsync.ChunkingFixed,
+                    Usage: "fixed size blocks, or content defined chunks (cdc) averaging --blocksize. cdc indexes are always hashed as a stream",
+                },
             },
         },
     )
@@ -47,35 +70,66 @@ func Build(c *cli.Context) error {
     var (
         filename    = c.Args()[0]
         //outfilePath = filename[:len(filename)-len(filepath.Ext(filename))] + ".pcsync"
-        blocksize   = uint32(c.Int("blocksize"))
         quite       = c.Bool("quite")
         outputDir   = c.String("output-dir")
-
-        generator   = filechecksum.NewFileChecksumGenerator(uint(blocksize))
-        outBuf      = new(bytes.Buffer)
     )
     log.SetLevel(log.DebugLevel)
 
-    absInputPath, err := filepath.Abs(filename)
+    strongHash, err := pcsync.ParseStrongHash(c.String("strong-hash"))
     if err != nil {
-        if !quite {
-            handleFileError(absInputPath, err)
-        }
         return errors.WithStack(err)
     }
-    inputFile, err := os.Open(absInputPath)
-    if err != nil {
-        if !quite {
-            handleFileError(absInputPath, err)
+    // a negative or too large --blocksize must not wrap around into a valid one
+    if c.Int("blocksize") < 0 || int64(c.Int("blocksize")) > math.MaxUint32 {
+        return errors.Errorf("block size %v is out of range", c.Int("blocksize"))
+    }
+    var (
+        blocksize = uint32(c.Int("blocksize"))
+        opts      = pcsync.Options{
+            BlockSize:  blocksize,
+            StrongHash: strongHash,
+            Chunking:   c.String("chunking"),
+            Workers:    c.Int("p"),
         }
+    )
+    // the output isn't created for an index readers would refuse
+    if err := opts.Validate(); err != nil {
         return errors.WithStack(err)
     }
-    defer inputFile.Close()
 
-    // if output is not specified...
-    outfilePath := strings.Split(filepath.Base(absInputPath), ".")[0] + ".pcsync"
-    if len(outputDir) != 0 {
-        outfilePath = filepath.Join(filepath.Dir(outputDir), filepath.Base(outfilePath))
+    var (
+        inputFile *os.File = nil
+        outfilePath = c.String("output")
+    )
+    if filename == "-" {
+        inputFile = os.Stdin
+        if len(outfilePath) == 0 {
+            return errors.New("--output is required when reading from stdin")
+        }
+    } else {
+        absInputPath, err := filepath.Abs(filename)
+        if err != nil {
+            if !quite {
+                handleFileError(absInputPath, err)
+            }
+            return errors.WithStack(err)
+        }
+        inputFile, err = os.Open(absInputPath)
+        if err != nil {
+            if !quite {
+                handleFileError(absInputPath, err)
+            }
+            return errors.WithStack(err)
+        }
+        defer inputFile.Close()
+
+        // if output is not specified...
+        if len(outfilePath) == 0 {
+            outfilePath = strings.Split(filepath.Base(absInputPath), ".")[0] + ".pcsync"
+            if len(outputDir) != 0 {
+                outfilePath = filepath.Join(filepath.Dir(outputDir), filepath.Base(outfilePath))
+            }
+        }
     }
     absOutputPath, err := filepath.Abs(outfilePath)
     if err != nil {
@@ -93,8 +147,13 @@ func Build(c *cli.Context) error {
     }
     defer outputFile.Close()
 
-    start := time.Now()
-    rtcs, blockcount, err := generator.BuildSequentialAndRootChecksum(inputFile, outBuf)
+    var start = time.Now()
+    header, err := pcsync.BuildTo(
+        context.Background(),
+        inputFile,
+        outputFile,
+        opts,
+    )
     end := time.Now()
     if err != nil {
         if !quite {
@@ -103,52 +162,17 @@ func Build(c *cli.Context) error {
         return errors.WithStack(err)
     }
 
-    stat, err := inputFile.Stat()
-    if err != nil {
-        if !quite {
-            log.Error(errors.WithStack(err).Error())
-        }
-        return errors.WithStack(err)
-    }
-    file_size := stat.Size()
-
-    if err = writeHeaders(
-        outputFile,
-        file_size,
-        blocksize,
-        blockcount,
-        rtcs,
-    ); err != nil {
-        if !quite {
-            log.Error(errors.WithMessage(err, "Error getting file info:"+filename).Error())
-        }
-        return errors.WithStack(err)
-    }
-
-    wrLen, err := outputFile.Write(outBuf.Bytes())
-    if err != nil {
-        if !quite {
-            log.Error(errors.WithMessage(err, "Error saving checksum :" + filename).Error())
-        }
-        return errors.WithStack(err)
-    }
-    if wrLen != outBuf.Len() {
-        if !quite {
-            log.Error(errors.Errorf("Error saving checksum to file: checksum length %v vs written %v", outBuf.Len(), wrLen).Error())
-        }
-        return errors.WithStack(err)
-    }
-
     if !quite {
-        log.Infof("Filename %s | BlockSize %v | BlockCount %v | RootChecksum %v | Index for %v file generated in %v",
+        log.Infof("Filename %s | BlockSize %v | BlockCount %v | StrongHash %v | RootChecksum %v | Index for %v file generated in %v",
             filename,
             blocksize,
-            blockcount,
-            rtcs,
-            file_size,
+            header.BlockCount,
+            strongHash,
+            header.RootHash,
+            header.FileSize,
             end.Sub(start))
     } else {
-        fmt.Fprint(os.Stdout, base64.URLEncoding.EncodeToString(rtcs))
+        fmt.Fprint(os.Stdout, base64.URLEncoding.EncodeToString(header.RootHash))
     }
     return nil
 }
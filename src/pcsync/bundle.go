@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "os"
+    "runtime"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/urfave/cli"
+    "golang.org/x/crypto/ed25519"
+    "pcsync/pcsync"
+)
+
+const (
+    bundleUsage string = "pcsync bundle <new index> <old file> <new file> <output bundle>"
+)
+
+func init() {
+    app.Commands = append(
+        app.Commands,
+        cli.Command{
+            Name:      "bundle",
+            Usage:     bundleUsage,
+            Description: `Write the blocks of <new file> that <old file> lacks, and the index, to a bundle file, for offline updates.
+<old file> is matched the same way diff and patch --seed do. "pcsync patch --bundle <output bundle> <output>" then
+rebuilds the new file from the old one and the bundle, with no network.
+<new index> may be a local, unc network path or http/https url. Its detached signature (<new index>.sig, or --signature)
+is carried in the bundle when there's one.`,
+            Action: Bundle,
+            Flags: append([]cli.Flag{
+                cli.IntFlag{
+                    Name:  "p",
+                    Value: runtime.NumCPU(),
+                    Usage: "The number of streams to use concurrently when matching the old file",
+                },
+            }, append(signatureFlags, httpFlags...)...),
+        },
+    )
+}
+
+func Bundle(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 4 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", bundleUsage)
+    }
+    var (
+        indexName  = c.Args()[0]
+        oldName    = c.Args()[1]
+        newName    = c.Args()[2]
+        bundleName = c.Args()[3]
+        signature  []byte = nil
+    )
+    idx, indexData, err := loadIndexData(c, indexName)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    // a signature given explicitly must be there. the default one is carried when there's one
+    if signatureName := c.String("signature"); len(signatureName) != 0 {
+        if signature, err = readSignature(c, signatureName); err != nil {
+            return err
+        }
+    } else if signatureReader, err := getLocalOrRemoteFile(c, signaturePath(indexName)); err == nil {
+        signature, err = readKeyFile(signatureReader, signaturePath(indexName), ed25519.SignatureSize)
+        signatureReader.Close()
+        if err != nil {
+            return errors.WithStack(err)
+        }
+    }
+
+    bundleFile, err := os.Create(bundleName)
+    if err != nil {
+        handleFileError(bundleName, err)
+        return errors.WithStack(err)
+    }
+    progress, stopReport := startProgressReport()
+    result, err := pcsync.WriteBundle(
+        context.Background(),
+        bundleFile,
+        pcsync.BundleOptions{
+            Index:     idx,
+            IndexData: indexData,
+            Signature: signature,
+            Old:       oldName,
+            New:       newName,
+            Matchers:  c.Int("p"),
+            Progress:  progress,
+        },
+    )
+    stopReport()
+    if err == nil {
+        err = bundleFile.Sync()
+    }
+    if closeErr := bundleFile.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(bundleName)
+        return errors.WithStack(err)
+    }
+    log.Infof("%v written | %v bytes in %v spans | %v bytes matched in %v | signed %v | Time taken: %v",
+        bundleName, result.BundledBytes, result.Spans, result.MatchedBytes, oldName, signature != nil, result.Duration)
+    return nil
+}
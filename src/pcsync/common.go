@@ -1,23 +1,19 @@
 package main
 
 import (
-    "bufio"
     "bytes"
-    "encoding/binary"
+    "fmt"
     "io"
-    "net/http"
     "net/url"
     "os"
+    "path/filepath"
+    "sync/atomic"
+    "time"
 
     log "github.com/Sirupsen/logrus"
     "github.com/pkg/errors"
     "github.com/urfave/cli"
-    gosync "github.com/Redundancy/go-sync"
-    "github.com/Redundancy/go-sync/chunks"
-    "github.com/Redundancy/go-sync/comparer"
-    "github.com/Redundancy/go-sync/filechecksum"
-    "github.com/Redundancy/go-sync/index"
-    "github.com/Redundancy/go-sync/patcher"
+    "pcsync/pcsync"
 )
 
 const (
@@ -25,6 +21,9 @@ const (
     KB = 1024
     // MB - One Megabyte
     MB = 1000000
+
+    // the largest remote file accepted, the largest index the library reads
+    maxRemoteFileSize int64 = pcsync.MaxIndexSize
 )
 
 func errorWrapper(c *cli.Context, f func(*cli.Context) error) {
@@ -80,204 +79,223 @@ func handleFileError(filename string, err error) {
     log.Error(errors.WithStack(formatFileError(filename, err)).Error())
 }
 
-func getLocalOrRemoteFile(path string) (io.ReadCloser, error) {
+// the http options of the commands requesting remote indexes or repositories
+var httpFlags = []cli.Flag{
+    cli.StringFlag{
+        Name:  "http-config",
+        Value: defaultHTTPConfigPath(),
+        Usage: "a JSON file of http options (timeout, retries, backoff, user_agent, proxy, ca_file, cert_file, key_file), overridden by the flags. empty to disable",
+    },
+    cli.DurationFlag{
+        Name:  "timeout",
+        Usage: "the timeout of a repository request, for repositories that don't set their own, and of each read of a remote index (default 10s)",
+    },
+    cli.IntFlag{
+        Name:  "retries",
+        Usage: "the number of times a failed repository or remote index request is retried, with exponential backoff",
+    },
+    cli.DurationFlag{
+        Name:  "backoff",
+        Usage: "the wait before the first retry, doubling with every retry (default 500ms)",
+    },
+    cli.StringFlag{
+        Name:  "user-agent",
+        Usage: "the user agent of every request (default pcsync/<version> (<os>; <arch>))",
+    },
+    cli.StringFlag{
+        Name:  "proxy",
+        Usage: "the proxy url of every request (default from HTTP_PROXY, HTTPS_PROXY and NO_PROXY)",
+    },
+    cli.StringFlag{
+        Name:  "ca-file",
+        Usage: "a PEM bundle of certificate authorities to trust along with the system's",
+    },
+    cli.StringFlag{
+        Name:  "cert-file",
+        Usage: "a PEM client certificate, for repositories requiring one",
+    },
+    cli.StringFlag{
+        Name:  "key-file",
+        Usage: "the PEM key of the client certificate",
+    },
+}
+
+func defaultHTTPConfigPath() string {
+    home := os.Getenv("HOME")
+    if len(home) == 0 {
+        return ""
+    }
+    return filepath.Join(home, ".pcsync", "http.json")
+}
+
+// reads the http configuration file of the command, and overrides it with the flags given
+func httpOptions(c *cli.Context) (pcsync.HTTPOptions, error) {
+    var opts pcsync.HTTPOptions
+    if config := c.String("http-config"); len(config) != 0 {
+        var err error
+        if opts, err = pcsync.LoadHTTPOptions(config); err != nil {
+            return opts, err
+        }
+    }
+    if c.IsSet("timeout") {
+        opts.Timeout = pcsync.Duration(c.Duration("timeout"))
+    }
+    if c.IsSet("backoff") {
+        opts.Backoff = pcsync.Duration(c.Duration("backoff"))
+    }
+    if c.IsSet("retries") {
+        opts.Retries = c.Int("retries")
+    }
+    for name, option := range map[string]*string{
+        "user-agent": &opts.UserAgent,
+        "proxy":      &opts.Proxy,
+        "ca-file":    &opts.CAFile,
+        "cert-file":  &opts.CertFile,
+        "key-file":   &opts.KeyFile,
+    } {
+        if c.IsSet(name) {
+            *option = c.String(name)
+        }
+    }
+    return opts, nil
+}
+
+// opens a local (or unc network) path, or fetches an http/https url going through the http options of the command, with
+// its timeout and retries. remote content larger than maxRemoteFileSize is refused.
+func getLocalOrRemoteFile(c *cli.Context, path string) (io.ReadCloser, error) {
     url, err := url.Parse(path)
 
     switch {
     case err != nil:
         return os.Open(path)
-    case url.Scheme == "":
-        return os.Open(path)
-    default:
-        response, err := http.Get(path)
-
+    case url.Scheme == "http" || url.Scheme == "https":
+        opts, err := httpOptions(c)
         if err != nil {
             return nil, err
         }
-
-        if response.StatusCode < 200 || response.StatusCode > 299 {
-            return nil, errors.Errorf("Request to %v returned status: %v", path, response.Status)
+        body, err := opts.Fetch(path)
+        if err != nil {
+            return nil, err
         }
 
-        return response.Body, nil
+        return &limitedReadCloser{
+            Reader: io.LimitReader(body, maxRemoteFileSize + 1),
+            Closer: body,
+            path:   path,
+            remain: maxRemoteFileSize,
+        }, nil
+    default:
+        // windows drive letters parse as a scheme
+        return os.Open(path)
     }
 }
 
-func toPatcherFoundSpan(sl comparer.BlockSpanList, blockSize int64) []patcher.FoundBlockSpan {
-    result := make([]patcher.FoundBlockSpan, len(sl))
-
-    for i, v := range sl {
-        result[i].StartBlock = v.StartBlock
-        result[i].EndBlock = v.EndBlock
-        result[i].MatchOffset = v.ComparisonStartOffset
-        result[i].BlockSize = blockSize
-    }
-
-    return result
+// limitedReadCloser fails reading once more than 'remain' bytes are read
+type limitedReadCloser struct {
+    io.Reader
+    io.Closer
+    path   string
+    remain int64
 }
 
-func toPatcherMissingSpan(sl comparer.BlockSpanList, blockSize int64) []patcher.MissingBlockSpan {
-    result := make([]patcher.MissingBlockSpan, len(sl))
-
-    for i, v := range sl {
-        result[i].StartBlock = v.StartBlock
-        result[i].EndBlock = v.EndBlock
-        result[i].BlockSize = blockSize
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+    n, err := l.Reader.Read(p)
+    l.remain -= int64(n)
+    if l.remain < 0 {
+        return n, errors.Errorf("Request to %v exceeds the limit of %v bytes", l.path, maxRemoteFileSize)
     }
-
-    return result
+    return n, err
 }
 
-func writeHeaders(
-    f          *os.File,
-    filesize   int64,
-    blocksize  uint32,
-    blockcount uint32,
-    rootHash   []byte,
-) error {
-    if _, err := f.WriteString(gosync.PocketSyncMagicString); err != nil {
-        return errors.WithStack(err)
-    }
-    for _, v := range []uint16{gosync.PocketSyncMajorVersion, gosync.PocketSyncMinorVersion, gosync.PocketSyncPatchVersion} {
-        if err := binary.Write(f, binary.LittleEndian, v); err != nil {
-            return errors.WithStack(err)
-        }
-    }
-    if err := binary.Write(f, binary.LittleEndian, filesize); err != nil {
-        return errors.WithStack(err)
-    }
-    if err := binary.Write(f, binary.LittleEndian, blocksize); err != nil {
-        return errors.WithStack(err)
-    }
-    if err := binary.Write(f, binary.LittleEndian, blockcount); err != nil {
-        return errors.WithStack(err)
-    }
-    var hLen uint32 = uint32(len(rootHash))
-    if err := binary.Write(f, binary.LittleEndian, hLen); err != nil {
-        return errors.WithStack(err)
+// returns a progress function for the library operations, and a function to stop reporting. progress is printed every second.
+func startProgressReport() (pcsync.ProgressFunc, func()) {
+    progress, stop := startProgressTicker(func(written, _ int64, percent, speed float64) {
+        printProgress(uint64(written), percent, speed)
+    })
+    return progress, func() {
+        stop()
+        fmt.Fprintln(os.Stdout)
     }
-    if err := binary.Write(f, binary.LittleEndian, rootHash); err != nil {
-        return errors.WithStack(err)
-    }
-    return nil
 }
 
-// reads the file headers and checks the magic string, then the semantic versioning
-// return : in order of 'filesize', 'blocksize', 'blockcount', 'rootHash', 'error'
-func readHeadersAndCheck(r io.Reader) (int64, uint32, uint32, []byte, error) {
+// returns a progress function, and a function to stop reporting. 'report' is called every second, and once more on stop.
+// speed is in bytes per second.
+func startProgressTicker(report func(written, total int64, percent, speed float64)) (pcsync.ProgressFunc, func()) {
     var (
-        bMagic                []byte = make([]byte, len(gosync.PocketSyncMagicString))
-        major, minor, patch   uint16 = 0, 0, 0
-        filesize              int64  = 0
-        blocksize, blockcount uint32 = 0, 0
-        hLen                  uint32 = 0
-        rootHash              []byte = nil
+        written int64 = 0
+        total   int64 = 0
+        start         = time.Now()
+        ticker        = time.NewTicker(time.Second)
+        done          = make(chan struct{})
     )
-    // magic string
-    if _, err := r.Read(bMagic); err != nil {
-        return 0, 0, 0, nil, errors.WithStack(err)
-    } else if string(bMagic) != gosync.PocketSyncMagicString {
-        return 0, 0, 0, nil, errors.New("meta header does not confirm. Not a valid meta")
-    }
-
-    // version
-    for _, v := range []*uint16{&major, &minor, &patch} {
-        if err := binary.Read(r, binary.LittleEndian, v); err != nil {
-            return 0, 0, 0, nil, errors.WithStack(err)
+    tick := func() {
+        w, t := atomic.LoadInt64(&written), atomic.LoadInt64(&total)
+        speed := float64(w) / time.Now().Sub(start).Seconds()
+        percent := 100.0
+        if t > 0 {
+            percent = float64(w) * 100.0 / float64(t)
         }
+        report(w, t, percent, speed)
     }
-    if major != gosync.PocketSyncMajorVersion || minor != gosync.PocketSyncMinorVersion || patch != gosync.PocketSyncPatchVersion {
-        return 0, 0, 0, nil, errors.Errorf("The acquired version (%v.%v.%v) does not match the tool (%v.%v.%v).",
-            major, minor, patch,
-            gosync.PocketSyncMajorVersion, gosync.PocketSyncMinorVersion, gosync.PocketSyncPatchVersion)
-    }
+    go func() {
+        for {
+            select {
+            case <-ticker.C:
+                tick()
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func(w, t int64) {
+            atomic.StoreInt64(&written, w)
+            atomic.StoreInt64(&total, t)
+        }, func() {
+            ticker.Stop()
+            close(done)
+            tick()
+        }
+}
 
-    if err := binary.Read(r, binary.LittleEndian, &filesize); err != nil {
-        return 0, 0, 0, nil, errors.WithStack(err)
-    }
-    if err := binary.Read(r, binary.LittleEndian, &blocksize); err != nil {
-        return 0, 0, 0, nil, errors.WithStack(err)
-    }
-    if err := binary.Read(r, binary.LittleEndian, &blockcount); err != nil {
-        return 0, 0, 0, nil, errors.WithStack(err)
-    }
-    if err := binary.Read(r, binary.LittleEndian, &hLen); err != nil {
-        return 0, 0, 0, nil, errors.WithStack(err)
-    }
-    rootHash = make([]byte, hLen)
-    if _, err := r.Read(rootHash); err != nil {
-        return 0, 0, 0, nil, errors.WithStack(err)
-    }
-    return filesize, blocksize, blockcount, rootHash, nil
+func printProgress(received uint64, percent float64, speed float64) {
+    fmt.Fprint(os.Stdout, fmt.Sprintf("Recieved %v | Progress %.1f | Speed %.1f\r", received, percent, speed / float64(1024 * 1024)))
 }
 
-func readIndex(rd io.Reader, blocksize, blockcount uint, rootHash []byte) (*index.ChecksumIndex, filechecksum.ChecksumLookup, error) {
-    var (
-        generator    = filechecksum.NewFileChecksumGenerator(blocksize)
-        idx          *index.ChecksumIndex = nil
-        chksumLookup filechecksum.ChecksumLookup  = nil
-    )
+// reads a whole local or remote index, and checks its signature when the command is given trusted keys
+func loadIndex(c *cli.Context, indexName string) (*pcsync.Index, error) {
+    idx, _, err := readIndexFile(c, indexName, false)
+    return idx, err
+}
 
-    readChunks, err := chunks.CountedLoadChecksumsFromReader(
-        rd,
-        blockcount,
-        generator.GetWeakRollingHash().Size(),
-        generator.GetStrongHash().Size(),
-    )
+// loadIndexData is loadIndex, also returning the index bytes as read, which its signature covers whatever the version
+func loadIndexData(c *cli.Context, indexName string) (*pcsync.Index, []byte, error) {
+    return readIndexFile(c, indexName, true)
+}
+
+func readIndexFile(c *cli.Context, indexName string, keepData bool) (*pcsync.Index, []byte, error) {
+    indexReader, err := getLocalOrRemoteFile(c, indexName)
     if err != nil {
-        return nil, nil, errors.WithStack(err)
+        return nil, nil, errors.WithMessage(err, "unable to open reference index " + indexName)
     }
+    defer indexReader.Close()
 
-    chksumLookup = chunks.StrongChecksumGetter(readChunks)
-    idx = index.MakeChecksumIndex(readChunks)
-    cRootHash, err := idx.SequentialChecksumList().RootHash()
+    var (
+        r    io.Reader     = indexReader
+        data *bytes.Buffer = nil
+    )
+    if keepData {
+        data = new(bytes.Buffer)
+        r = io.TeeReader(indexReader, data)
+    }
+    idx, err := pcsync.ReadIndex(r)
     if err != nil {
-        return nil, nil, errors.WithStack(err)
+        return nil, nil, errors.WithMessage(err, "Error loading index")
     }
-    if bytes.Compare(cRootHash, rootHash) != 0 {
-        return nil, nil, errors.Errorf("[ERR] mismatching integrity checksum")
+    if err := checkIndexSignature(c, indexName, idx.Header()); err != nil {
+        return nil, nil, err
     }
-
-    return idx, chksumLookup, nil
-}
-
-func multithreadedMatching(
-    localFile     *os.File,
-    idx           *index.ChecksumIndex,
-    localFileSize int64,
-    matcherCount  int64,
-    blocksize     uint,
-) (*comparer.MatchMerger, *comparer.Comparer) {
-    // Note: Since not all sections of the file are equal in work
-    // it would be better to divide things up into more sections and
-    // pull work from a queue channel as each finish
-    sectionSize := localFileSize / matcherCount
-    sectionSize += int64(blocksize) - (sectionSize % int64(blocksize))
-    merger := &comparer.MatchMerger{}
-    compare := &comparer.Comparer{}
-
-    for i := int64(0); i < matcherCount; i++ {
-        offset := sectionSize * i
-
-        // Sections must overlap by blocksize (strictly blocksize - 1?)
-        if i > 0 {
-            offset -= int64(blocksize)
-        }
-
-        sectionReader := bufio.NewReaderSize(
-            io.NewSectionReader(localFile, offset, sectionSize),
-            MB,
-        )
-
-        sectionGenerator := filechecksum.NewFileChecksumGenerator(uint(blocksize))
-
-        matchStream := compare.StartFindMatchingBlocks(
-            sectionReader, offset, sectionGenerator, idx)
-
-        merger.StartMergeResultStream(matchStream, int64(blocksize))
+    if data == nil {
+        return idx, nil, nil
     }
-
-    return merger, compare
+    return idx, data.Bytes(), nil
 }
-
-// better way to do this?
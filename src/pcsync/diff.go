@@ -1,12 +1,20 @@
 package main
 
 import (
+    "context"
+    "encoding/json"
+    "os"
     "runtime"
     "time"
 
     log "github.com/Sirupsen/logrus"
     "github.com/pkg/errors"
     "github.com/urfave/cli"
+    "pcsync/pcsync"
+)
+
+const (
+    diffUsage string = "gosync diff <localfile> <reference.gosync>"
 )
 
 func init() {
@@ -15,27 +23,78 @@ func init() {
         cli.Command{
             Name:        "diff",
             ShortName:   "d",
-            Usage:       "gosync diff <localfile> <reference.gosync>",
-            Description: `Compare a file with a reference index, and print statistics on the comparison and performance.`,
+            Usage:       diffUsage,
+            Description: `Compare a file with a reference index, and print statistics on the comparison and performance.
+<reference.gosync> may be a local, unc network path or http/https url.
+With --trusted-key, the index must carry a detached signature (see "pcsync sign") by one of the keys.
+With --json, stdout carries a single JSON report with the matched and missing block ranges, and nothing else.`,
             Action:      Diff,
-            Flags: []cli.Flag{
+            Flags: append([]cli.Flag{
                 cli.IntFlag{
                     Name:  "p",
                     Value: runtime.NumCPU(),
                     Usage: "The number of streams to use concurrently",
                 },
-            },
+                cli.BoolFlag{
+                    Name:  "json",
+                    Usage: "print the report as JSON, with the matched and missing block ranges",
+                },
+            }, append(signatureFlags, httpFlags...)...),
         },
     )
 }
 
+type diffRange struct {
+    StartBlock  uint  `json:"start_block"`
+    EndBlock    uint  `json:"end_block"`
+    // the byte range [start, end) in the reference file
+    Start       int64 `json:"start"`
+    End         int64 `json:"end"`
+    LocalOffset *int64 `json:"local_offset,omitempty"`
+}
+
+type diffReport struct {
+    Local          string      `json:"local"`
+    Index          string      `json:"index"`
+    LocalSize      int64       `json:"local_size"`
+    Filesize       int64       `json:"filesize"`
+    Blocksize      uint32      `json:"blocksize"`
+    Chunking       string      `json:"chunking"`
+    StrongHash     string      `json:"strong_hash"`
+    IndexBlocks    uint        `json:"index_blocks"`
+    MatchedBlocks  uint        `json:"matched_blocks"`
+    MatchedBytes   int64       `json:"matched_bytes"`
+    MissingBlocks  uint        `json:"missing_blocks"`
+    MissingBytes   int64       `json:"missing_bytes"`
+    // matched bytes out of the reference file size
+    MatchedRatio   float64     `json:"matched_ratio"`
+    Matched        []diffRange `json:"matched"`
+    Missing        []diffRange `json:"missing"`
+    // the rolling hash statistics of fixed size blocks
+    WeakCount      int         `json:"weak_count"`
+    Comparisons    int64       `json:"comparisons"`
+    WeakHashHits   int64       `json:"weak_hash_hits"`
+    StrongHashHits int64       `json:"strong_hash_hits"`
+    IndexMs        int64       `json:"index_ms"`
+    MatchMs        int64       `json:"match_ms"`
+    TotalMs        int64       `json:"total_ms"`
+}
+
 func Diff(c *cli.Context) error {
+    if len(c.Args()) < 2 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", diffUsage)
+    }
     var (
         localFilename     string = c.Args()[0]
         referenceFilename string = c.Args()[1]
         startTime      time.Time = time.Now()
+        jsonReport             = c.Bool("json")
     )
     log.SetLevel(log.DebugLevel)
+    if jsonReport {
+        // stdout only carries the report
+        log.SetOutput(os.Stderr)
+    }
 
     localFile := openFileAndHandleError(localFilename)
     if localFile == nil {
@@ -43,91 +102,102 @@ func Diff(c *cli.Context) error {
     }
     defer localFile.Close()
 
-    referenceFile := openFileAndHandleError(referenceFilename)
-    if referenceFile == nil {
-        return errors.Errorf("unable to open reference file %v", referenceFilename)
-    }
-    defer referenceFile.Close()
-
-    _, blocksize, blockcount, rootHash, err := readHeadersAndCheck(referenceFile)
-    if err != nil {
-        return errors.WithMessage(err, "Error loading index")
-    }
-
-    log.Infof("Blocksize: %v", blocksize)
-    index, _, err := readIndex(referenceFile, uint(blocksize), uint(blockcount), rootHash)
-    referenceFile.Close()
+    idx, err := loadIndex(c, referenceFilename)
     if err != nil {
         return errors.WithStack(err)
     }
+    indexTime := time.Now().Sub(startTime)
+    header := idx.Header()
 
-    log.Infof("Weak hash count: %v", index.WeakCount())
     fi, err := localFile.Stat()
     if err != nil {
         return errors.WithMessage(err, "Could not get info on file:")
     }
-
-    var (
-        num_matchers   = int64(c.Int("p"))
-        localFile_size = fi.Size()
-    )
-    // Don't split up small files
-    if localFile_size < 1024*1024 {
-        num_matchers = 1
+    result, err := pcsync.Diff(context.Background(), localFile, fi.Size(), idx, c.Int("p"))
+    if err != nil {
+        return errors.WithStack(err)
     }
 
-    merger, compare := multithreadedMatching(
-        localFile,
-        index,
-        localFile_size,
-        num_matchers,
-        uint(blocksize),
-    )
-
-    mergedBlocks := merger.GetMergedBlocks()
-
-    log.Infof("\nMatched:")
-    totalMatchingSize := uint64(0)
-    matchedBlockCountAfterMerging := uint(0)
-
-    for _, b := range mergedBlocks {
-        totalMatchingSize += uint64(b.EndBlock-b.StartBlock+1) * uint64(blocksize)
-        matchedBlockCountAfterMerging += b.EndBlock - b.StartBlock + 1
+    report := &diffReport{
+        Local:          localFilename,
+        Index:          referenceFilename,
+        LocalSize:      fi.Size(),
+        Filesize:       header.FileSize,
+        Blocksize:      header.BlockSize,
+        Chunking:       pcsync.ChunkingFixed,
+        StrongHash:     header.StrongHash.String(),
+        IndexBlocks:    result.IndexBlocks,
+        MatchedBlocks:  result.MatchedBlocks,
+        MatchedBytes:   result.MatchedBytes,
+        MissingBlocks:  result.MissingBlocks,
+        MissingBytes:   result.MissingBytes,
+        MatchedRatio:   1,
+        Matched:        []diffRange{},
+        Missing:        []diffRange{},
+        WeakCount:      idx.WeakCount(),
+        Comparisons:    result.Comparisons,
+        WeakHashHits:   result.WeakHashHits,
+        StrongHashHits: result.StrongHashHits,
+        IndexMs:        int64(indexTime / time.Millisecond),
+        MatchMs:        int64(result.Duration / time.Millisecond),
+        TotalMs:        int64(time.Now().Sub(startTime) / time.Millisecond),
     }
-
-    log.Infof("Comparisons: %v", compare.Comparisons)
-    log.Infof("Weak hash hits: %v", compare.WeakHashHits)
-
-    if compare.Comparisons > 0 {
-        log.Infof(
-            "Weak hit rate: %.2f%%\n",
-            100.0*float64(compare.WeakHashHits)/float64(compare.Comparisons),
-        )
+    if header.Chunking != nil {
+        report.Chunking = pcsync.ChunkingCDC
     }
-
-    log.Infof("Strong hash hits:", compare.StrongHashHits)
-    if compare.WeakHashHits > 0 {
-        log.Infof(
-            "Weak hash error rate: %.2f%%\n",
-            100.0*float64(compare.WeakHashHits-compare.StrongHashHits)/float64(compare.WeakHashHits),
-        )
+    if header.FileSize > 0 {
+        report.MatchedRatio = float64(result.MatchedBytes) / float64(header.FileSize)
+    }
+    for _, r := range result.Matched {
+        localOffset := r.LocalOffset
+        report.Matched = append(report.Matched, diffRange{StartBlock: r.StartBlock, EndBlock: r.EndBlock, Start: r.Start, End: r.End, LocalOffset: &localOffset})
+    }
+    for _, r := range result.Missing {
+        report.Missing = append(report.Missing, diffRange{StartBlock: r.StartBlock, EndBlock: r.EndBlock, Start: r.Start, End: r.End})
     }
 
-    log.Infof("Total matched bytes: %v", totalMatchingSize)
-    log.Infof("Total matched blocks: %v", matchedBlockCountAfterMerging)
-
-    // TODO: GetMissingBlocks uses the highest index, not the count, this can be pretty confusing
-    // Should clean up this interface to avoid that
-    missing := mergedBlocks.GetMissingBlocks(uint(index.BlockCount) - 1)
-    log.Infof("Index blocks: %v", index.BlockCount)
+    if jsonReport {
+        return errors.WithStack(json.NewEncoder(os.Stdout).Encode(report))
+    }
+    printDiffReport(report, header)
+    return nil
+}
 
-    totalMissingSize := uint64(0)
-    for _, b := range missing {
-        //fmt.Printf("%#v\n", b)
-        totalMissingSize += uint64(b.EndBlock-b.StartBlock+1) * uint64(blocksize)
+func printDiffReport(report *diffReport, header *pcsync.Header) {
+    if header.Chunking != nil {
+        log.Infof("Chunk sizes: min %v, avg %v, max %v", header.Chunking.Min, header.Chunking.Avg, header.Chunking.Max)
+    } else {
+        log.Infof("Blocksize: %v", report.Blocksize)
+    }
+    log.Infof("Strong hash: %v", report.StrongHash)
+
+    // content defined indexes are matched by chunking the local file with the same parameters
+    if header.Chunking == nil {
+        log.Infof("Weak hash count: %v", report.WeakCount)
+        log.Infof("\nMatched:")
+        log.Infof("Comparisons: %v", report.Comparisons)
+        log.Infof("Weak hash hits: %v", report.WeakHashHits)
+
+        if report.Comparisons > 0 {
+            log.Infof(
+                "Weak hit rate: %.2f%%\n",
+                100.0*float64(report.WeakHashHits)/float64(report.Comparisons),
+            )
+        }
+
+        log.Infof("Strong hash hits: %v", report.StrongHashHits)
+        if report.WeakHashHits > 0 {
+            log.Infof(
+                "Weak hash error rate: %.2f%%\n",
+                100.0*float64(report.WeakHashHits-report.StrongHashHits)/float64(report.WeakHashHits),
+            )
+        }
     }
 
-    log.Infof("Approximate missing bytes: %v", totalMissingSize)
-    log.Infof("Time taken: %v", time.Now().Sub(startTime))
-    return nil
+    log.Infof("Total matched bytes: %v (%.2f%%)", report.MatchedBytes, 100.0*report.MatchedRatio)
+    log.Infof("Total matched blocks: %v", report.MatchedBlocks)
+    log.Infof("Index blocks: %v", report.IndexBlocks)
+    log.Infof("Missing bytes: %v in %v blocks, %v ranges", report.MissingBytes, report.MissingBlocks, len(report.Missing))
+    log.Infof("Time taken: %v (index %v, matching %v)", time.Duration(report.TotalMs) * time.Millisecond,
+        time.Duration(report.IndexMs) * time.Millisecond, time.Duration(report.MatchMs) * time.Millisecond)
 }
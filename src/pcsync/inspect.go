@@ -0,0 +1,175 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "text/tabwriter"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/urfave/cli"
+    gosync "github.com/Redundancy/go-sync"
+    "pcsync/pcsync"
+)
+
+const (
+    inspectUsage string = "gosync inspect <reference index>"
+)
+
+func init() {
+    app.Commands = append(
+        app.Commands,
+        cli.Command{
+            Name:      "inspect",
+            ShortName: "i",
+            Usage:     inspectUsage,
+            Description: `Print the header of an index and check its root checksum.
+<reference index> may be a local, unc network path or http/https url.`,
+            Action: Inspect,
+            Flags: append([]cli.Flag{
+                cli.BoolFlag{
+                    Name:  "blocks",
+                    Usage: "print the weak and strong checksum of every block",
+                },
+                cli.BoolFlag{
+                    Name:  "json",
+                    Usage: "print as JSON",
+                },
+            }, httpFlags...),
+        },
+    )
+}
+
+type inspectBlock struct {
+    Block  uint   `json:"block"`
+    Offset int64  `json:"offset"`
+    Length int64  `json:"length"`
+    // content defined chunks have no weak checksum
+    Weak   string `json:"weak,omitempty"`
+    Strong string `json:"strong"`
+}
+
+type inspectReport struct {
+    Magic          string            `json:"magic"`
+    Version        string            `json:"version"`
+    Filesize       int64             `json:"filesize"`
+    Blocksize      uint32            `json:"blocksize"`
+    Blockcount     uint32            `json:"blockcount"`
+    StrongHash     string            `json:"strong_hash"`
+    Chunking       string            `json:"chunking"`
+    OptionalFields map[uint16]string `json:"optional_fields,omitempty"`
+    RootHash       string            `json:"root_hash"`
+    RootHashMatch  bool              `json:"root_hash_match"`
+    Blocks         []inspectBlock    `json:"blocks,omitempty"`
+}
+
+func Inspect(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 1 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", inspectUsage)
+    }
+    var (
+        indexName  = c.Args()[0]
+        showBlocks = c.Bool("blocks")
+    )
+
+    indexReader, err := getLocalOrRemoteFile(c, indexName)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    defer indexReader.Close()
+
+    header, err := pcsync.ReadHeader(indexReader)
+    if err != nil {
+        return errors.WithMessage(err, "Error loading index")
+    }
+    var (
+        blocks    []inspectBlock = nil
+        chunking  = pcsync.ChunkingFixed
+    )
+    if header.Chunking != nil {
+        chunking = fmt.Sprintf("%v (min %v, avg %v, max %v)", pcsync.ChunkingCDC, header.Chunking.Min, header.Chunking.Avg, header.Chunking.Max)
+    }
+    // ReadIndex refuses a mismatching root checksum, which inspect reports instead
+    indexBlocks, cRootHash, err := pcsync.ReadBlocks(indexReader, header)
+    if err != nil {
+        return errors.WithMessage(err, "Error loading block checksums")
+    }
+    for _, b := range indexBlocks {
+        blocks = append(blocks, inspectBlock{
+            Block:  b.ID,
+            Offset: b.Offset,
+            Length: b.Length,
+            Weak:   hex.EncodeToString(b.Weak),
+            Strong: hex.EncodeToString(b.Strong),
+        })
+    }
+
+    report := &inspectReport{
+        Magic:         gosync.PocketSyncMagicString,
+        Version:       fmt.Sprintf("%v.%v.%v", header.Major, header.Minor, header.Patch),
+        Filesize:      header.FileSize,
+        Blocksize:     header.BlockSize,
+        Blockcount:    header.BlockCount,
+        StrongHash:    header.StrongHash.String(),
+        Chunking:      chunking,
+        RootHash:      base64.URLEncoding.EncodeToString(header.RootHash),
+        RootHashMatch: bytes.Compare(cRootHash, header.RootHash) == 0,
+    }
+    if len(header.Optional) != 0 {
+        report.OptionalFields = map[uint16]string{}
+        for tag, value := range header.Optional {
+            report.OptionalFields[tag] = hex.EncodeToString(value)
+        }
+    }
+    if showBlocks {
+        report.Blocks = blocks
+    }
+
+    if c.Bool("json") {
+        err = json.NewEncoder(os.Stdout).Encode(report)
+    } else {
+        err = printInspectReport(report)
+    }
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if !report.RootHashMatch {
+        return errors.Errorf("[ERR] mismatching integrity checksum %v", base64.URLEncoding.EncodeToString(cRootHash))
+    }
+    return nil
+}
+
+func printInspectReport(report *inspectReport) error {
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "Magic\t%v\n", report.Magic)
+    fmt.Fprintf(w, "Version\t%v\n", report.Version)
+    fmt.Fprintf(w, "Filesize\t%v\n", report.Filesize)
+    fmt.Fprintf(w, "Blocksize\t%v\n", report.Blocksize)
+    fmt.Fprintf(w, "Blockcount\t%v\n", report.Blockcount)
+    fmt.Fprintf(w, "StrongHash\t%v\n", report.StrongHash)
+    fmt.Fprintf(w, "Chunking\t%v\n", report.Chunking)
+    var tags []int = nil
+    for tag := range report.OptionalFields {
+        tags = append(tags, int(tag))
+    }
+    sort.Ints(tags)
+    for _, tag := range tags {
+        fmt.Fprintf(w, "Optional %v\t%v\n", tag, report.OptionalFields[uint16(tag)])
+    }
+    fmt.Fprintf(w, "RootHash\t%v\n", report.RootHash)
+    fmt.Fprintf(w, "RootHashMatch\t%v\n", report.RootHashMatch)
+    if len(report.Blocks) != 0 {
+        fmt.Fprintf(w, "\nBlock\tOffset\tLength\tWeak\tStrong\n")
+        for _, b := range report.Blocks {
+            fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", b.Block, b.Offset, b.Length, b.Weak, b.Strong)
+        }
+    }
+    return w.Flush()
+}
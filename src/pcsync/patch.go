@@ -1,24 +1,22 @@
 package main
 
 import (
-    "bufio"
-    "fmt"
-    "io"
+    "context"
     "os"
+    "path/filepath"
+    "runtime"
     "time"
 
     log "github.com/Sirupsen/logrus"
     "github.com/pkg/errors"
     "github.com/urfave/cli"
-    "github.com/Redundancy/go-sync/blockrepository"
-    "github.com/Redundancy/go-sync/blocksources"
-    "github.com/Redundancy/go-sync/filechecksum"
-    "github.com/Redundancy/go-sync/patcher"
-    "github.com/Redundancy/go-sync/patcher/multisources"
-    "github.com/Redundancy/go-sync/showpipe"
+    "pcsync/pcsync"
 )
 
-const usage = "gosync patch <reference index> <reference repository list> <output>"
+const (
+    usage            string = "gosync patch <reference index> <reference repository list> <output>"
+    bundlePatchUsage string = "pcsync patch --bundle <bundle> [--seed <old file>] <output>"
+)
 
 func init() {
     app.Commands = append(
@@ -31,124 +29,220 @@ func init() {
 The index should be produced by "gosync build".
 
 <reference index> is a .gosync file and may be a local, unc network path or http/https url.
-<reference repository list> is corresponding repository list in .text file format.
-<output> is the local file will be overwritten when done.`,
+<reference repository list> is the repository list, in JSON or one url per line (see "pcsync repo"). Repositories are
+tried by priority, and the requests are shared by weight among the best ones.
+<output> is the local file will be overwritten when done. The reference is written to <output>.pcsync-part, and only
+replaces <output> once its root checksum matches the index, so a failed patch leaves <output> untouched.
+
+When --seed is given, blocks found in the seed file are copied locally and only the missing blocks are requested from the repositories.
+The seed may be <output> itself.
+Progress is recorded in <output>.pcsync-state, so an interrupted patch resumes with the blocks that are still missing.
+With --trusted-key, the index must carry a detached signature (see "pcsync sign") by one of the keys.
+Requests go through the http options of --http-config (~/.pcsync/http.json), overridden by --timeout, --retries, --proxy,
+--ca-file and the other http flags. They apply to the remote index as well as to the repositories.
+With --bundle, "pcsync patch --bundle <bundle> [--seed <old file>] <output>" rebuilds the new file from the old file and the
+blocks of the bundle, with no network. Every block the bundle doesn't carry has to be found in the old file, which is
+<output> itself without --seed, when it exists.
+With --trusted-key, the signature carried in the bundle is checked.
+With --peer-listen, the verified blocks of <output> are served to the other nodes patching the same index, which add this
+node with --peer before their repositories (see "pcsync peer").
+With --progress=json, stdout carries one JSON event per line and nothing else, for installers to drive the patch.`,
             Action: Patch,
+            Flags: append([]cli.Flag{
+                cli.StringFlag{
+                    Name:  "seed",
+                    Usage: "a local file believed to be similar to the reference (e.g. the previous image)",
+                },
+                cli.IntFlag{
+                    Name:  "p",
+                    Value: runtime.NumCPU(),
+                    Usage: "The number of streams to use concurrently when matching the seed file",
+                },
+                cli.StringFlag{
+                    Name:  "bundle",
+                    Usage: "patch from a bundle (see \"pcsync bundle\") with no network. the index comes from the bundle, and the only argument is <output>. --seed defaults to <output>",
+                },
+                cli.BoolFlag{
+                    Name:  "no-resume",
+                    Usage: "discard any previous progress and patch the whole file again",
+                },
+                cli.StringFlag{
+                    Name:  "mirror-state",
+                    Value: defaultMirrorStatePath(),
+                    Usage: "the file keeping the score of every repository across runs. faster and healthier repositories are preferred. patches running at once keep the scores of the last one to finish. empty to disable",
+                },
+                regionFlag,
+                cli.StringFlag{
+                    Name:  "progress",
+                    Value: progressText,
+                    Usage: "text, or json for newline delimited JSON events on stdout (start, progress, source, error, summary) with logs on stderr",
+                },
+            }, append(append(signatureFlags, httpFlags...), peerFlags...)...),
         },
     )
 }
 
 // Patch a file
 func Patch(c *cli.Context) error {
-    log.SetLevel(log.DebugLevel)
-    log.Infof("Starting patching process")
-    if len(c.Args()) < 3 {
-        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", usage)
-    }
     var (
-        refIndexName  = c.Args()[0]
-        refListName   = c.Args()[1]
-        outFileName   = c.Args()[2]
+        startTime = time.Now()
+        events    *jsonEvents = nil
     )
-    if len(refIndexName) == 0 {
-        return errors.Errorf("Usage is \"%v\" (invalid reference index filename)", usage)
-    }
-    if len(refListName) == 0 {
-        return errors.Errorf("Usage is \"%v\" (invalid reference repository list filename)", usage)
-    }
-    if len(outFileName) == 0 {
-        return errors.Errorf("Usage is \"%v\" (invalid output filename)", usage)
+    log.SetLevel(log.DebugLevel)
+    switch c.String("progress") {
+    case progressText:
+    case progressJSON:
+        // stdout only carries the events
+        log.SetOutput(os.Stderr)
+        events = newJSONEvents(os.Stdout)
+    default:
+        return errors.Errorf("unknown progress format '%v'. use one of %v, %v", c.String("progress"), progressText, progressJSON)
     }
 
-    // index file
-    indexReader, err := os.Open(refIndexName)
-    if err != nil {
-        return errors.WithStack(err)
-    }
-    // read repository list
-    refListReader, err := os.Open(refListName)
-    if err != nil {
-        return errors.WithStack(err)
-    }
-    // otuput file
-    outFile, err := os.Create(outFileName)
-    if err != nil {
-        return errors.WithStack(err)
+    result, err := patchFile(c, events)
+    if events != nil {
+        if err != nil {
+            events.error(err)
+        }
+        events.summary(result, err, time.Now().Sub(startTime))
     }
-    defer func() {
-        indexReader.Close()
-        refListReader.Close()
-        outFile.Close()
-    }()
+    return err
+}
 
-    // read index & build checksum
-    filesize, blocksize, blockcount, rootHash, err := readHeadersAndCheck(indexReader)
-    if err != nil {
-        return errors.WithStack(err)
+func patchFile(c *cli.Context, events *jsonEvents) (*pcsync.PatchResult, error) {
+    log.Infof("Starting patching process")
+    var (
+        idx          *pcsync.Index = nil
+        refIndexName string
+        outFileName  string
+        sourceList   []pcsync.Repository = nil
+        bundle       *pcsync.Bundle = nil
+        err          error = nil
+    )
+    if bundleName := c.String("bundle"); len(bundleName) != 0 {
+        if len(c.Args()) < 1 || len(c.Args()[0]) == 0 {
+            return nil, errors.Errorf("Usage is \"%v\" (invalid output filename)", bundlePatchUsage)
+        }
+        outFileName, refIndexName = c.Args()[0], bundleName
+        if bundle, err = pcsync.OpenBundle(bundleName); err != nil {
+            return nil, errors.WithStack(err)
+        }
+        defer bundle.Close()
+        if err := checkBundleSignature(c, bundle); err != nil {
+            return nil, err
+        }
+        idx = bundle.Index()
+    } else {
+        if len(c.Args()) < 3 {
+            return nil, errors.Errorf("Usage is \"%v\" (invalid number of arguments)", usage)
+        }
+        var refListName string
+        refIndexName, refListName, outFileName = c.Args()[0], c.Args()[1], c.Args()[2]
+        if len(refIndexName) == 0 {
+            return nil, errors.Errorf("Usage is \"%v\" (invalid reference index filename)", usage)
+        }
+        if len(refListName) == 0 {
+            return nil, errors.Errorf("Usage is \"%v\" (invalid reference repository list filename)", usage)
+        }
+        if len(outFileName) == 0 {
+            return nil, errors.Errorf("Usage is \"%v\" (invalid output filename)", usage)
+        }
+        // read index & build checksum
+        if idx, err = loadIndex(c, refIndexName); err != nil {
+            return nil, errors.WithStack(err)
+        }
+        // read repository list
+        refListReader, err := os.Open(refListName)
+        if err != nil {
+            return nil, errors.WithStack(err)
+        }
+        sourceList, err = pcsync.ReadRepositoryList(refListReader)
+        refListReader.Close()
+        if err != nil {
+            return nil, errors.WithStack(err)
+        }
+        if peers := c.StringSlice("peer"); len(peers) != 0 {
+            sourceList = pcsync.PeerRepositories(peers, idx.Header(), sourceList)
+        }
     }
-    index, _, err := readIndex(indexReader, uint(blocksize), uint(blockcount), rootHash)
+
+    httpOpts, err := httpOptions(c)
     if err != nil {
-        return errors.WithStack(err)
+        return nil, errors.WithStack(err)
     }
 
-    // read repository list
     var (
-        scanner  *bufio.Scanner = bufio.NewScanner(refListReader)
-        resolver = blockrepository.MakeKnownFileSizedBlockResolver(int64(blocksize), filesize)
-        verifier = &filechecksum.HashVerifier{
-            Hash:                filechecksum.DefaultStrongHashGenerator(),
-            BlockSize:           uint(blocksize),
-            BlockChecksumGetter: index,
+        opts = pcsync.PatchOptions{
+            Index:        idx,
+            Repositories: sourceList,
+            Region:       c.String("region"),
+            Output:       outFileName,
+            Seed:         c.String("seed"),
+            Matchers:     c.Int("p"),
+            NoResume:     c.Bool("no-resume"),
+            HTTP:         httpOpts,
+            Bundle:       bundle,
         }
-
-        sourceList []string = nil
-        repoList   []patcher.BlockRepository = nil
+        mirrorState = c.String("mirror-state")
+        stopReport func() = nil
     )
-    for scanner.Scan() {
-        sourceList = append(sourceList, scanner.Text())
+    if len(mirrorState) != 0 && bundle == nil {
+        mirrors, err := pcsync.LoadMirrorScores(mirrorState)
+        if err != nil {
+            // a broken state file only loses the preference
+            log.Warnf("unable to load mirror scores : %v", err.Error())
+        } else {
+            defer func() {
+                if err := mirrors.Save(mirrorState); err != nil {
+                    log.Warnf("unable to save mirror scores : %v", err.Error())
+                }
+            }()
+            opts.Mirrors = mirrors
+        }
     }
-    err = scanner.Err()
-    if err != nil {
-        return errors.WithStack(err)
+    if events != nil {
+        events.start(startEvent{
+            Index:      refIndexName,
+            Output:     outFileName,
+            Seed:       opts.Seed,
+            Filesize:   idx.Header().FileSize,
+            Blockcount: idx.Header().BlockCount,
+            Sources:    patchSources(sourceList, bundle),
+        })
+        opts.Progress, stopReport = events.startProgress()
+        opts.OnSource = events.source
+    } else {
+        opts.Progress, stopReport = startProgressReport()
     }
-    for rID, src := range sourceList {
-        log.Infof("%v : %v", rID, src)
-        repoList = append(repoList,
-            blockrepository.NewBlockRepositoryBase(
-                uint(rID),
-                blocksources.NewRequesterWithTimeout(src, "PocketCluster/0.1.4 (OSX)", false, time.Duration(10) * time.Second),
-                resolver,
-                verifier))
+    stopPeer := startPatchPeer(c, idx, outFileName)
+    result, err := pcsync.Patch(context.Background(), opts)
+    stopReport()
+    stopPeer(err == nil)
+    if result != nil && events == nil {
+        printSourceStats(result.Sources)
     }
+    return result, err
+}
 
-    pipeReader, pipeWriter, pipeReporter := showpipe.PipeWithReport(uint64(filesize))
-    defer func() {
-        pipeReader.Close()
-        pipeWriter.Close()
-    }()
-    go func() {
-        for rpt := range pipeReporter {
-            fmt.Fprint(os.Stdout, fmt.Sprintf("Recieved %v | Progress %.1f | Speed %.1f\r", rpt.Received, (rpt.DonePercent * 100.0), rpt.Speed / float64(1024 * 1024)))
-        }
-    }()
-    msync, err := multisources.NewMultiSourcePatcher(pipeWriter, repoList, index)
-    if err != nil {
-        return errors.WithStack(err)
+func patchSources(sourceList []pcsync.Repository, bundle *pcsync.Bundle) []string {
+    if bundle != nil {
+        return []string{bundle.Name()}
     }
-    log.Infof("BlockSize %v/ BlockCount %v/ RootChecksum %v\nStart patching %v for the size of %v",blocksize, blockcount, rootHash, outFileName, filesize)
-    go func() {
-        _, err := io.Copy(outFile, pipeReader)
-        if err != nil {
-            log.Infof("%v", err.Error())
-        }
-    }()
-    start := time.Now()
-    err = msync.Patch()
-    end := time.Now()
-    if err != nil {
-        return errors.WithStack(err)
+    return pcsync.RepositoryURLs(sourceList)
+}
+
+// returns ~/.pcsync/mirrors.json, or nothing without a home directory
+func defaultMirrorStatePath() string {
+    home := os.Getenv("HOME")
+    if len(home) == 0 {
+        return ""
     }
-    log.Infof("Time duration %v | Data Rate %v/sec",end.Sub(start).Seconds(), int64(float64(filesize) / end.Sub(start).Seconds()))
+    return filepath.Join(home, ".pcsync", "mirrors.json")
+}
 
-    return errors.WithStack(msync.Close())
+func printSourceStats(sources []pcsync.SourceStats) {
+    for _, s := range sources {
+        log.Infof("%v : %v | Bytes %v | Requests %v | Blocks %v | Failures %v | Verification failures %v | Average latency %v",
+            s.SourceID, s.Source, s.Bytes, s.Requests, s.Blocks, s.Failures, s.VerifyFailures, s.AverageLatency())
+    }
 }
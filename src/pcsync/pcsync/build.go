@@ -0,0 +1,314 @@
+package pcsync
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "io"
+    "io/ioutil"
+    "os"
+    "sync"
+
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/chunks"
+)
+
+const (
+    // sections smaller than this aren't worth a goroutine of their own
+    buildMinSectionSize int64 = 64 * mb
+)
+
+// Options configure how an index is built
+type Options struct {
+    // the block size, or the average chunk size with content defined chunking
+    BlockSize  uint32
+    StrongHash StrongHash
+    // ChunkingFixed (the default) or ChunkingCDC
+    Chunking   string
+    // the number of sections of a regular file hashed concurrently. fixed size blocks only
+    Workers    int
+}
+
+// Validate checks the options before anything is read or written
+func (o Options) Validate() error {
+    _, err := placeholderHeader(o)
+    return err
+}
+
+// Build builds the index of r in memory. A regular *os.File is hashed in sections concurrently, anything else as a stream.
+func Build(ctx context.Context, r io.Reader, opts Options) (*Index, error) {
+    body := new(bytes.Buffer)
+    header, err := buildBody(ctx, r, body, opts)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkBuiltHeader(header); err != nil {
+        return nil, err
+    }
+    if err := writeTrailer(body, header); err != nil {
+        return nil, err
+    }
+    return readIndexBody(body, header)
+}
+
+// BuildTo builds the index of r straight into w, without holding the checksums of a stream in memory. The header is
+// written first with a placeholder filesize and root checksum, and is rewritten in place once the input ends. w is left
+// at the end of the trailer.
+func BuildTo(ctx context.Context, r io.Reader, w io.WriteSeeker, opts Options) (*Header, error) {
+    placeholder, err := placeholderHeader(opts)
+    if err != nil {
+        return nil, err
+    }
+    start, err := w.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if err := writeHeader(w, placeholder); err != nil {
+        return nil, err
+    }
+
+    out := bufio.NewWriterSize(w, mb)
+    header, err := buildBody(ctx, r, out, opts)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkBuiltHeader(header); err != nil {
+        return nil, err
+    }
+    if err := writeTrailer(out, header); err != nil {
+        return nil, err
+    }
+    if err := out.Flush(); err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if len(header.RootHash) != len(placeholder.RootHash) {
+        return nil, errors.Errorf("root checksum length %v differs from the reserved %v", len(header.RootHash), len(placeholder.RootHash))
+    }
+    end, err := w.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if _, err := w.Seek(start, io.SeekStart); err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if err := writeHeader(w, header); err != nil {
+        return nil, err
+    }
+    if _, err := w.Seek(end, io.SeekStart); err != nil {
+        return nil, errors.WithStack(err)
+    }
+    return header, nil
+}
+
+// the size of the input is only known once it's read. an input with more blocks than readers accept fails the build
+// rather than writing an index nothing can read
+func checkBuiltHeader(header *Header) error {
+    if err := checkIndexHeader(header); err != nil {
+        return errors.WithMessage(err, "the index would be refused by readers")
+    }
+    return nil
+}
+
+// returns a header with the fields of the options, and a zero root checksum of the length the build will produce.
+// the root checksum has the same length for any file, so a one byte file tells the space to reserve.
+func placeholderHeader(opts Options) (*Header, error) {
+    header := &Header{
+        Major:      indexMajorVersion,
+        Minor:      indexMinorVersion,
+        Patch:      indexPatchVersion,
+        BlockSize:  opts.BlockSize,
+        StrongHash: opts.StrongHash,
+    }
+    if !opts.StrongHash.IsValid() {
+        return nil, errors.Errorf("unknown strong hash algorithm %v", uint16(opts.StrongHash))
+    }
+
+    var (
+        rootHash []byte = nil
+        err      error  = nil
+    )
+    switch opts.Chunking {
+    case "", ChunkingFixed:
+        // readers refuse indexes with blocks over maxIndexBlockSize
+        if opts.BlockSize == 0 || opts.BlockSize > maxIndexBlockSize {
+            return nil, errors.Errorf("block size %v is out of range (1-%v)", opts.BlockSize, maxIndexBlockSize)
+        }
+        rootHash, _, err = newChecksumGenerator(uint(opts.BlockSize), opts.StrongHash).BuildSequentialAndRootChecksum(bytes.NewReader([]byte{0}), ioutil.Discard)
+    case ChunkingCDC:
+        params, perr := NewCDCParams(opts.BlockSize)
+        if perr != nil {
+            return nil, perr
+        }
+        header.Chunking = &params
+        rootHash, err = cdcRootHash([]cdcChunk{{strong: make([]byte, opts.StrongHash.New().Size())}})
+    default:
+        return nil, errors.Errorf("unknown chunking '%v'. use one of %v, %v", opts.Chunking, ChunkingFixed, ChunkingCDC)
+    }
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    header.RootHash = make([]byte, len(rootHash))
+    return header, nil
+}
+
+// hashes the input, writing the index body to output
+// return : the header of the index
+func buildBody(ctx context.Context, r io.Reader, output io.Writer, opts Options) (*Header, error) {
+    header, err := placeholderHeader(opts)
+    if err != nil {
+        return nil, err
+    }
+
+    var (
+        input     = &contextReader{ctx: ctx, Reader: r}
+        blocksize = opts.BlockSize
+    )
+    if header.Chunking != nil {
+        header.RootHash, header.BlockCount, header.FileSize, err = buildCDCBody(bufio.NewReaderSize(input, mb), output, *header.Chunking, opts.StrongHash)
+        if err != nil {
+            return nil, err
+        }
+        return header, nil
+    }
+
+    // pipes and devices have no size to section by
+    if f, ok := r.(*os.File); ok && opts.Workers > 1 {
+        stat, err := f.Stat()
+        if err != nil {
+            return nil, errors.WithStack(err)
+        }
+        if stat.Mode().IsRegular() {
+            header.FileSize = stat.Size()
+            header.RootHash, header.BlockCount, err = buildChecksums(ctx, f, header.FileSize, blocksize, opts.StrongHash, opts.Workers, output)
+            if err != nil {
+                return nil, err
+            }
+            return header, nil
+        }
+    }
+
+    var (
+        counter   = &countingReader{Reader: input}
+        generator = newChecksumGenerator(uint(blocksize), opts.StrongHash)
+    )
+    header.RootHash, header.BlockCount, err = generator.BuildSequentialAndRootChecksum(bufio.NewReaderSize(counter, mb), output)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    header.FileSize = counter.count
+    return header, nil
+}
+
+// buildChecksums hashes the file in block aligned sections concurrently, and writes the block checksums to output in
+// order. The output and the root checksum are identical to those of BuildSequentialAndRootChecksum.
+func buildChecksums(
+    ctx        context.Context,
+    inputFile  io.ReaderAt,
+    filesize   int64,
+    blocksize  uint32,
+    strongHash StrongHash,
+    workers    int,
+    output     io.Writer,
+) ([]byte, uint32, error) {
+    // Don't split up small files
+    if workers <= 1 || filesize < buildMinSectionSize * 2 {
+        input := &contextReader{ctx: ctx, Reader: io.NewSectionReader(inputFile, 0, filesize)}
+        return newChecksumGenerator(uint(blocksize), strongHash).BuildSequentialAndRootChecksum(bufio.NewReaderSize(input, mb), output)
+    }
+
+    sectionSize := filesize / int64(workers)
+    if sectionSize < buildMinSectionSize {
+        sectionSize = buildMinSectionSize
+    }
+    if r := sectionSize % int64(blocksize); r != 0 {
+        sectionSize += int64(blocksize) - r
+    }
+
+    var (
+        sectionCount = int((filesize + sectionSize - 1) / sectionSize)
+        sections     = make([]*bytes.Buffer, sectionCount)
+        errs         = make([]error, sectionCount)
+        wg           sync.WaitGroup
+    )
+    for i := 0; i < sectionCount; i++ {
+        sections[i] = new(bytes.Buffer)
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            sectionReader := bufio.NewReaderSize(
+                &contextReader{ctx: ctx, Reader: io.NewSectionReader(inputFile, int64(i) * sectionSize, sectionSize)},
+                mb,
+            )
+            generator := newChecksumGenerator(uint(blocksize), strongHash)
+            _, errs[i] = generator.GenerateChecksums(sectionReader, sections[i])
+        }(i)
+    }
+    wg.Wait()
+
+    var readers []io.Reader = nil
+    for i := 0; i < sectionCount; i++ {
+        if errs[i] != nil {
+            return nil, 0, errors.WithStack(errs[i])
+        }
+        readers = append(readers, bytes.NewReader(sections[i].Bytes()))
+    }
+
+    // the root checksum is computed from the stitched checksums, the same way readers verify it
+    generator := newChecksumGenerator(uint(blocksize), strongHash)
+    readChunks, err := chunks.LoadChecksumsFromReader(
+        io.MultiReader(readers...),
+        generator.GetWeakRollingHash().Size(),
+        generator.GetStrongHash().Size(),
+    )
+    if err != nil {
+        return nil, 0, errors.WithStack(err)
+    }
+    rootHash, err := chunks.SequentialChecksumList(readChunks).RootHash()
+    if err != nil {
+        return nil, 0, errors.WithStack(err)
+    }
+    for i := 0; i < sectionCount; i++ {
+        if _, err := output.Write(sections[i].Bytes()); err != nil {
+            return nil, 0, errors.WithStack(err)
+        }
+        sections[i] = nil
+    }
+    return rootHash, uint32(len(readChunks)), nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+    io.Reader
+    count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.Reader.Read(p)
+    c.count += int64(n)
+    return n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+    io.Writer
+    count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+    n, err := c.Writer.Write(p)
+    c.count += int64(n)
+    return n, err
+}
+
+// contextReader fails reading once its context is done, which stops the hashing and matching loops reading from it
+type contextReader struct {
+    io.Reader
+    ctx context.Context
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+    if err := c.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return c.Reader.Read(p)
+}
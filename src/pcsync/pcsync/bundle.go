@@ -0,0 +1,352 @@
+package pcsync
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "io"
+    "io/ioutil"
+    "os"
+    "sort"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/patcher"
+)
+
+// A bundle carries an index and the blocks of its reference file that an older file lacks, so the reference can be
+// patched from the older file with no network. The layout is in fileformat.md.
+
+const (
+    bundleMagicString string = "PCSBDL"
+    bundleVersion     uint16 = 1
+    // the largest signature carried along the index
+    maxBundleSignatureSize = 1024
+)
+
+// BundleOptions configure WriteBundle
+type BundleOptions struct {
+    // the index of the new file
+    Index     *Index
+    // the bytes Index was read from, carried as they are, so the signature of indexes of older versions still holds
+    IndexData []byte
+    // the detached signature of the index, carried in the bundle. may be nil
+    Signature []byte
+    // the file the bundle will be patched against
+    Old       string
+    // the reference file of the index, where the missing blocks are read
+    New       string
+    // the number of concurrent matchers of the old file
+    Matchers  int
+    Progress  ProgressFunc
+}
+
+// BundleResult accounts for the blocks of a bundle
+type BundleResult struct {
+    Spans        int
+    // the bytes of the new file carried in the bundle
+    BundledBytes int64
+    // the bytes of the new file found in the old one
+    MatchedBytes int64
+    Duration     time.Duration
+}
+
+// WriteBundle matches the old file against the index the same way a patch with a seed does, and writes the index and the
+// blocks the old file lacks, read from the new file and checked against the index.
+func WriteBundle(ctx context.Context, w io.Writer, opts BundleOptions) (*BundleResult, error) {
+    var (
+        idx   = opts.Index
+        start = time.Now()
+    )
+    if len(opts.IndexData) == 0 {
+        return nil, errors.New("[ERR] the bytes of the index are required")
+    }
+    if len(opts.Signature) > maxBundleSignatureSize {
+        return nil, errors.Errorf("[ERR] signature of %v bytes, over the limit of %v", len(opts.Signature), maxBundleSignatureSize)
+    }
+    newFile, err := os.Open(opts.New)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer newFile.Close()
+    oldFile, err := os.Open(opts.Old)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer oldFile.Close()
+    oldStat, err := oldFile.Stat()
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+
+    done := make([]bool, idx.layout.blockCount())
+    if len(done) != 0 {
+        found, err := matchSeed(ctx, idx, oldFile, oldStat.Size(), int64(opts.Matchers))
+        if err != nil {
+            return nil, errors.WithMessage(err, "unable to match " + opts.Old)
+        }
+        for _, s := range found {
+            for b := s.StartBlock; b <= s.EndBlock; b++ {
+                done[b] = true
+            }
+        }
+    }
+    var (
+        missing = blockRanges(done, false)
+        result  = &BundleResult{Spans: len(missing)}
+    )
+    for _, s := range missing {
+        b, e := blockRangeOffsets(idx.layout, s.StartBlock, s.EndBlock)
+        result.BundledBytes += e - b
+    }
+    result.MatchedBytes = idx.header.FileSize - result.BundledBytes
+    log.Infof("%v bytes matched in %v | %v bytes in %v spans to bundle", result.MatchedBytes, opts.Old, result.BundledBytes, len(missing))
+
+    bw := bufio.NewWriterSize(w, mb)
+    if err := writeBundleHeader(bw, opts.IndexData, opts.Signature, missing); err != nil {
+        return nil, err
+    }
+    var (
+        fetcher = &blockFetcher{lookup: idx.lookup, strongHash: idx.header.StrongHash, layout: idx.layout}
+        written = newProgressCounter(result.BundledBytes, opts.Progress)
+        hasher  = idx.header.StrongHash.New()
+        buf     []byte = nil
+    )
+    for _, r := range splitMissingSpans(missing, fetcher.blocksPerRequest()) {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        b, e := fetcher.blockRangeOffsets(r.StartBlock, r.EndBlock)
+        if int64(cap(buf)) < e - b {
+            buf = make([]byte, e - b)
+        }
+        data := buf[:e - b]
+        if _, err := newFile.ReadAt(data, b); err != nil {
+            return nil, errors.WithMessage(err, "unable to read " + opts.New)
+        }
+        if bad := mismatchingBlocks(hasher, idx.lookup, idx.layout, r.StartBlock, data); len(bad) != 0 {
+            return nil, errors.Errorf("[ERR] blocks %v of %v do not match the index", bad, opts.New)
+        }
+        if _, err := bw.Write(data); err != nil {
+            return nil, errors.WithStack(err)
+        }
+        written(int64(len(data)))
+    }
+    if err := bw.Flush(); err != nil {
+        return nil, errors.WithStack(err)
+    }
+    result.Duration = time.Now().Sub(start)
+    return result, nil
+}
+
+func writeBundleHeader(w io.Writer, indexData []byte, signature []byte, spans []patcher.MissingBlockSpan) error {
+    for _, v := range []interface{}{
+        []byte(bundleMagicString),
+        bundleVersion,
+        uint64(len(indexData)),
+        indexData,
+        uint16(len(signature)),
+        signature,
+        uint32(len(spans)),
+    } {
+        if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+            return errors.WithStack(err)
+        }
+    }
+    for _, s := range spans {
+        if err := binary.Write(w, binary.LittleEndian, []uint32{uint32(s.StartBlock), uint32(s.EndBlock)}); err != nil {
+            return errors.WithStack(err)
+        }
+    }
+    return nil
+}
+
+// Bundle is an opened bundle file
+type Bundle struct {
+    name      string
+    file      *os.File
+    index     *Index
+    signature []byte
+    spans     []bundleSpan
+}
+
+// bundleSpan is a block range carried in a bundle, and where its data is in the bundle file
+type bundleSpan struct {
+    startBlock uint
+    endBlock   uint
+    start      int64
+    end        int64
+    position   int64
+}
+
+// OpenBundle reads the index and the span table of a bundle, and checks the bundle holds all their data. a malformed
+// bundle is a FormatError.
+func OpenBundle(name string) (*Bundle, error) {
+    f, err := os.Open(name)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    bundle, err := readBundle(f)
+    if err != nil {
+        f.Close()
+        return nil, errors.WithMessage(err, "invalid bundle " + name)
+    }
+    bundle.name = name
+    return bundle, nil
+}
+
+func readBundle(f *os.File) (*Bundle, error) {
+    var (
+        r         = &countingReader{Reader: bufio.NewReader(f)}
+        magic     = make([]byte, len(bundleMagicString))
+        version   uint16
+        indexSize uint64
+    )
+    if err := readIndexField(r, "bundle magic", magic); err != nil {
+        return nil, err
+    }
+    if string(magic) != bundleMagicString {
+        return nil, newIndexFormatError("bundle magic", "not a pcsync bundle")
+    }
+    if err := readIndexField(r, "bundle version", &version); err != nil {
+        return nil, err
+    }
+    if version != bundleVersion {
+        return nil, newIndexFormatError("bundle version", "unsupported version %v", version)
+    }
+    if err := readIndexField(r, "bundle index length", &indexSize); err != nil {
+        return nil, err
+    }
+    if indexSize > uint64(maxIndexBodySize) {
+        return nil, newIndexFormatError("bundle index length", "%v is more than the limit of %v", indexSize, maxIndexBodySize)
+    }
+    indexReader := io.LimitReader(r, int64(indexSize))
+    idx, err := ReadIndex(indexReader)
+    if err != nil {
+        return nil, err
+    }
+    // the index ends where its length says
+    if n, _ := io.Copy(ioutil.Discard, indexReader); n != 0 {
+        return nil, newIndexFormatError("bundle index length", "%v bytes after the index", n)
+    }
+
+    var signatureSize uint16
+    if err := readIndexField(r, "bundle signature length", &signatureSize); err != nil {
+        return nil, err
+    }
+    if signatureSize > maxBundleSignatureSize {
+        return nil, newIndexFormatError("bundle signature length", "%v is more than the limit of %v", signatureSize, maxBundleSignatureSize)
+    }
+    signature := make([]byte, signatureSize)
+    if err := readIndexField(r, "bundle signature", signature); err != nil {
+        return nil, err
+    }
+    var spanCount uint32
+    if err := readIndexField(r, "bundle span count", &spanCount); err != nil {
+        return nil, err
+    }
+    if uint(spanCount) > idx.layout.blockCount() {
+        return nil, newIndexFormatError("bundle span count", "%v spans for %v blocks", spanCount, idx.layout.blockCount())
+    }
+
+    var (
+        spans    = make([]bundleSpan, spanCount)
+        ranges   = make([]uint32, 2 * int(spanCount))
+        previous int64 = 0
+    )
+    if err := readIndexField(r, "bundle spans", ranges); err != nil {
+        return nil, err
+    }
+    // the blocks follow the span table
+    position := r.count
+    for i := range spans {
+        startBlock, endBlock := uint(ranges[2 * i]), uint(ranges[2 * i + 1])
+        if startBlock > endBlock || endBlock >= idx.layout.blockCount() {
+            return nil, newIndexFormatError("bundle spans", "blocks %v-%v out of the index", startBlock, endBlock)
+        }
+        start, end := blockRangeOffsets(idx.layout, startBlock, endBlock)
+        if start < previous {
+            return nil, newIndexFormatError("bundle spans", "blocks %v-%v overlap or are out of order", startBlock, endBlock)
+        }
+        spans[i] = bundleSpan{startBlock: startBlock, endBlock: endBlock, start: start, end: end, position: position}
+        position += end - start
+        previous = end
+    }
+    stat, err := f.Stat()
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if stat.Size() != position {
+        return nil, newIndexFormatError("bundle blocks", "%v bytes, expected %v. the bundle is truncated or has trailing data", stat.Size(), position)
+    }
+    return &Bundle{file: f, index: idx, signature: signature, spans: spans}, nil
+}
+
+// Index returns the index of the bundle. its signature has to be checked by the caller.
+func (b *Bundle) Index() *Index {
+    return b.index
+}
+
+// Signature returns the detached signature of the index carried in the bundle, or nothing
+func (b *Bundle) Signature() []byte {
+    if len(b.signature) == 0 {
+        return nil
+    }
+    return b.signature
+}
+
+// returns which of the index blocks the bundle carries. the others are to be found in the file it was made against.
+func (b *Bundle) bundledBlocks() []bool {
+    bundled := make([]bool, b.index.layout.blockCount())
+    for _, s := range b.spans {
+        for block := s.startBlock; block <= s.endBlock; block++ {
+            bundled[block] = true
+        }
+    }
+    return bundled
+}
+
+func (b *Bundle) Name() string {
+    return b.name
+}
+
+func (b *Bundle) Close() error {
+    return b.file.Close()
+}
+
+// bundleRequester serves block ranges from the spans of a bundle, like a repository would. data is verified by the fetcher.
+type bundleRequester struct {
+    bundle *Bundle
+}
+
+func (r *bundleRequester) DoRequest(start, end int64) ([]byte, error) {
+    var (
+        spans = r.bundle.spans
+        data  = make([]byte, 0, end - start)
+    )
+    for offset := start; offset < end; {
+        i := sort.Search(len(spans), func(i int) bool {
+            return spans[i].end > offset
+        })
+        if i == len(spans) || spans[i].start > offset {
+            return nil, errors.Errorf("[ERR] the bundle lacks bytes %v-%v. it was made against another file", offset, end - 1)
+        }
+        n := spans[i].end - offset
+        if n > end - offset {
+            n = end - offset
+        }
+        piece := make([]byte, n)
+        if _, err := r.bundle.file.ReadAt(piece, spans[i].position + (offset - spans[i].start)); err != nil {
+            return nil, errors.WithStack(err)
+        }
+        data = append(data, piece...)
+        offset += n
+    }
+    return data, nil
+}
+
+// the bundle won't get the missing bytes by asking again
+func (r *bundleRequester) IsFatal(err error) bool {
+    return true
+}
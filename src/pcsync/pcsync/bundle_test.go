@@ -0,0 +1,106 @@
+package pcsync
+
+import (
+    "bytes"
+    "context"
+    "io/ioutil"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// a bundle carrying every block patches an output that doesn't exist yet, with no seed
+func TestPatchFullBundleWithoutOutput(t *testing.T) {
+    dir, reference := bundleTestFiles(t)
+    defer os.RemoveAll(dir)
+    bundle := writeTestBundle(t, dir, reference, nil)
+    defer bundle.Close()
+
+    output := filepath.Join(dir, "output")
+    if _, err := Patch(context.Background(), PatchOptions{Index: bundle.Index(), Output: output, Bundle: bundle}); err != nil {
+        t.Fatalf("unable to patch from a full bundle : %v", err)
+    }
+    data, err := ioutil.ReadFile(output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(data, reference) {
+        t.Fatal("the patched output differs from the reference")
+    }
+}
+
+// a bundle lacking blocks, with no seed to take them from, fails before anything is read from the bundle
+func TestPatchPartialBundleWithoutOutput(t *testing.T) {
+    dir, reference := bundleTestFiles(t)
+    defer os.RemoveAll(dir)
+    // the old file has all but the first blocks of the reference, which the bundle lacks then
+    old := append(make([]byte, 32 * kb), reference[32 * kb:]...)
+    bundle := writeTestBundle(t, dir, reference, old)
+    defer bundle.Close()
+
+    output := filepath.Join(dir, "output")
+    _, err := Patch(context.Background(), PatchOptions{Index: bundle.Index(), Output: output, Bundle: bundle})
+    if err == nil || !strings.Contains(err.Error(), "no seed file") {
+        t.Fatalf("patching a partial bundle without a seed returned %v", err)
+    }
+    if _, err := os.Stat(output); !os.IsNotExist(err) {
+        t.Fatalf("the output was created : %v", err)
+    }
+}
+
+// returns a temporary directory, and the reference file written in it
+func bundleTestFiles(t *testing.T) (string, []byte) {
+    dir, err := ioutil.TempDir("", "pcsync-bundle")
+    if err != nil {
+        t.Fatal(err)
+    }
+    reference := make([]byte, 200 * kb + 123)
+    rand.New(rand.NewSource(1)).Read(reference)
+    if err := ioutil.WriteFile(filepath.Join(dir, "reference"), reference, 0644); err != nil {
+        os.RemoveAll(dir)
+        t.Fatal(err)
+    }
+    return dir, reference
+}
+
+// writes the bundle of the reference against old, empty when nil, and opens it
+func writeTestBundle(t *testing.T, dir string, reference []byte, old []byte) *Bundle {
+    idx, err := Build(context.Background(), bytes.NewReader(reference), Options{BlockSize: 8 * kb, StrongHash: DefaultStrongHash})
+    if err != nil {
+        t.Fatal(err)
+    }
+    indexData := new(bytes.Buffer)
+    if _, err := idx.WriteTo(indexData); err != nil {
+        t.Fatal(err)
+    }
+    oldName := filepath.Join(dir, "old")
+    if err := ioutil.WriteFile(oldName, old, 0644); err != nil {
+        t.Fatal(err)
+    }
+    bundleName := filepath.Join(dir, "bundle")
+    f, err := os.Create(bundleName)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = WriteBundle(context.Background(), f, BundleOptions{
+        Index:     idx,
+        IndexData: indexData.Bytes(),
+        Old:       oldName,
+        New:       filepath.Join(dir, "reference"),
+    })
+    if err == nil {
+        err = f.Close()
+    } else {
+        f.Close()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    bundle, err := OpenBundle(bundleName)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return bundle
+}
@@ -0,0 +1,391 @@
+package pcsync
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io"
+
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/chunks"
+    "github.com/Redundancy/go-sync/patcher"
+)
+
+// Content defined chunking (FastCDC) splits a file where a rolling gear hash of its content hits a mask, rather than at
+// fixed offsets. An insertion only changes the chunks around it, where every later fixed block would shift.
+
+const (
+    ChunkingFixed string = "fixed"
+    ChunkingCDC   string = "cdc"
+
+    // the smallest average chunk size, and the largest chunk size accepted from an index
+    cdcMinAverageSize = 256
+    cdcMaxChunkSize   = 64 * mb
+    // the chunker reads this far past the largest chunk, or up to twice the largest chunk when it's smaller. its buffer
+    // starts at cdcChunkerInitialSize, and only grows as the input fills it
+    cdcChunkerReadAhead   = 4 * mb
+    cdcChunkerInitialSize = 64 * kb
+)
+
+// the gear table must never change, or indexes would no longer chunk the same way. it's generated with splitmix64.
+var cdcGear [256]uint64
+
+func init() {
+    var seed uint64 = 0x5043535943444300
+    for i := range cdcGear {
+        seed += 0x9e3779b97f4a7c15
+        z := seed
+        z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+        z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+        cdcGear[i] = z ^ (z >> 31)
+    }
+}
+
+// CDCParams are the chunk size bounds of a content defined index. they're recorded in the critical 'chunking' header field.
+type CDCParams struct {
+    Min uint32
+    Avg uint32
+    Max uint32
+}
+
+// NewCDCParams returns the usual FastCDC bounds : a quarter and four times the average
+func NewCDCParams(avg uint32) (CDCParams, error) {
+    p := CDCParams{Min: avg / 4, Avg: avg, Max: avg * 4}
+    return p, p.validate()
+}
+
+func (p CDCParams) validate() error {
+    if p.Avg < cdcMinAverageSize || p.Min == 0 || p.Min > p.Avg || p.Avg > p.Max || p.Max > cdcMaxChunkSize {
+        return errors.Errorf("invalid content defined chunk sizes (min %v, avg %v, max %v)", p.Min, p.Avg, p.Max)
+    }
+    return nil
+}
+
+func (p CDCParams) marshal() []byte {
+    b := make([]byte, 12)
+    binary.LittleEndian.PutUint32(b[0:4], p.Min)
+    binary.LittleEndian.PutUint32(b[4:8], p.Avg)
+    binary.LittleEndian.PutUint32(b[8:12], p.Max)
+    return b
+}
+
+func unmarshalCDCParams(b []byte) (CDCParams, error) {
+    if len(b) != 12 {
+        return CDCParams{}, errors.Errorf("invalid chunking header field length %v", len(b))
+    }
+    p := CDCParams{
+        Min: binary.LittleEndian.Uint32(b[0:4]),
+        Avg: binary.LittleEndian.Uint32(b[4:8]),
+        Max: binary.LittleEndian.Uint32(b[8:12]),
+    }
+    return p, p.validate()
+}
+
+// returns the length of the first chunk of data. data must hold at least max bytes, unless it's the end of the file.
+// normalized chunking : a stricter mask before the average size and a looser one after it.
+func (p CDCParams) cutPoint(data []byte) int {
+    var (
+        n      = len(data)
+        normal = int(p.Avg)
+        bits   = uint(0)
+        fp     uint64 = 0
+    )
+    if n <= int(p.Min) {
+        return n
+    }
+    if n > int(p.Max) {
+        n = int(p.Max)
+    }
+    if normal > n {
+        normal = n
+    }
+    for v := p.Avg; v > 1; v >>= 1 {
+        bits++
+    }
+    var (
+        maskS = ^uint64(0) << (64 - (bits + 1))
+        maskL = ^uint64(0) << (64 - (bits - 1))
+        i     = int(p.Min)
+    )
+    for ; i < normal; i++ {
+        fp = (fp << 1) + cdcGear[data[i]]
+        if fp & maskS == 0 {
+            return i + 1
+        }
+    }
+    for ; i < n; i++ {
+        fp = (fp << 1) + cdcGear[data[i]]
+        if fp & maskL == 0 {
+            return i + 1
+        }
+    }
+    return n
+}
+
+// cdcChunker splits a stream into content defined chunks
+type cdcChunker struct {
+    params  CDCParams
+    r       io.Reader
+    buf     []byte
+    // the size the buffer grows up to : the largest chunk and the read ahead
+    maxSize int
+    start   int
+    end     int
+    offset  int64
+    eof     bool
+}
+
+func newCDCChunker(r io.Reader, params CDCParams) *cdcChunker {
+    var (
+        readAhead = int(params.Max)
+        size      = cdcChunkerInitialSize
+    )
+    if readAhead > cdcChunkerReadAhead {
+        readAhead = cdcChunkerReadAhead
+    }
+    if size > int(params.Max) + readAhead {
+        size = int(params.Max) + readAhead
+    }
+    return &cdcChunker{
+        params:  params,
+        r:       r,
+        buf:     make([]byte, size),
+        maxSize: int(params.Max) + readAhead,
+    }
+}
+
+// returns the next chunk and its offset. the data is only valid until the next call. io.EOF after the last chunk.
+func (c *cdcChunker) next() ([]byte, int64, error) {
+    if c.end - c.start < int(c.params.Max) && !c.eof {
+        copy(c.buf, c.buf[c.start:c.end])
+        c.end -= c.start
+        c.start = 0
+        for c.end < c.maxSize && !c.eof {
+            // the buffer grows with the input, so a short file never takes the whole buffer the chunk sizes allow
+            if c.end == len(c.buf) {
+                size := len(c.buf) * 2
+                if size > c.maxSize {
+                    size = c.maxSize
+                }
+                buf := make([]byte, size)
+                copy(buf, c.buf[:c.end])
+                c.buf = buf
+            }
+            n, err := c.r.Read(c.buf[c.end:])
+            c.end += n
+            if err == io.EOF {
+                c.eof = true
+            } else if err != nil {
+                return nil, 0, errors.WithStack(err)
+            }
+        }
+    }
+    if c.start == c.end {
+        return nil, 0, io.EOF
+    }
+    var (
+        cut    = c.params.cutPoint(c.buf[c.start:c.end])
+        chunk  = c.buf[c.start:c.start + cut]
+        offset = c.offset
+    )
+    c.start += cut
+    c.offset += int64(cut)
+    return chunk, offset, nil
+}
+
+type cdcChunk struct {
+    offset int64
+    length uint32
+    strong []byte
+}
+
+// cdcIndex is a content defined index. chunks take the place of blocks : chunk ids are block ids for journals and spans.
+type cdcIndex struct {
+    params   CDCParams
+    filesize int64
+    chunks   []cdcChunk
+    byStrong map[string][]uint
+}
+
+func (idx *cdcIndex) blockCount() uint {
+    return uint(len(idx.chunks))
+}
+
+func (idx *cdcIndex) blockOffsets(blockID uint) (int64, int64) {
+    c := idx.chunks[blockID]
+    return c.offset, c.offset + int64(c.length)
+}
+
+func (idx *cdcIndex) GetStrongChecksumForBlock(blockID int) []byte {
+    if blockID < 0 || blockID >= len(idx.chunks) {
+        return nil
+    }
+    return idx.chunks[blockID].strong
+}
+
+// the merkle root of the chunk strong checksums, in order
+func cdcRootHash(chunkList []cdcChunk) ([]byte, error) {
+    list := make(chunks.SequentialChecksumList, len(chunkList))
+    for i, c := range chunkList {
+        list[i] = chunks.ChunkChecksum{
+            ChunkOffset:    uint(i),
+            Size:           int64(c.length),
+            StrongChecksum: c.strong,
+        }
+    }
+    return list.RootHash()
+}
+
+// the body of a content defined index repeats : offset int64 LE, length uint32 LE, strong checksum
+func writeCDCChunk(w io.Writer, c cdcChunk) error {
+    if err := binary.Write(w, binary.LittleEndian, c.offset); err != nil {
+        return errors.WithStack(err)
+    }
+    if err := binary.Write(w, binary.LittleEndian, c.length); err != nil {
+        return errors.WithStack(err)
+    }
+    _, err := w.Write(c.strong)
+    return errors.WithStack(err)
+}
+
+// reads the chunk list of a content defined index as is
+func readCDCChunks(rd io.Reader, header *Header) ([]cdcChunk, error) {
+    var (
+        strongSize = header.StrongHash.New().Size()
+        chunkList  []cdcChunk = nil
+    )
+    for i := uint32(0); i < header.BlockCount; i++ {
+        c := cdcChunk{strong: make([]byte, strongSize)}
+        if err := readIndexField(rd, "chunk offset", &c.offset); err != nil {
+            return nil, err
+        }
+        if err := readIndexField(rd, "chunk length", &c.length); err != nil {
+            return nil, err
+        }
+        if err := readIndexField(rd, "chunk checksum", c.strong); err != nil {
+            return nil, err
+        }
+        chunkList = append(chunkList, c)
+    }
+    return chunkList, nil
+}
+
+// reads the chunks of a content defined index, checks they cover the file contiguously, and checks the root hash
+func readCDCIndex(rd io.Reader, header *Header) (*cdcIndex, error) {
+    chunkList, err := readCDCChunks(rd, header)
+    if err != nil {
+        return nil, err
+    }
+    var (
+        idx = &cdcIndex{
+            params:   *header.Chunking,
+            filesize: header.FileSize,
+            chunks:   chunkList,
+            byStrong: map[string][]uint{},
+        }
+        expected int64 = 0
+    )
+    for i, c := range chunkList {
+        if c.offset != expected || c.length == 0 || c.length > idx.params.Max {
+            return nil, newIndexFormatError("chunks", "chunk %v at %v (%v bytes) does not follow the previous chunk", i, c.offset, c.length)
+        }
+        expected += int64(c.length)
+        idx.byStrong[string(c.strong)] = append(idx.byStrong[string(c.strong)], uint(i))
+    }
+    if expected != header.FileSize {
+        return nil, newIndexFormatError("chunks", "chunks cover %v bytes, expected %v", expected, header.FileSize)
+    }
+    cRootHash, err := cdcRootHash(idx.chunks)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if bytes.Compare(cRootHash, header.RootHash) != 0 {
+        return nil, newIndexFormatError("root hash", "[ERR] mismatching integrity checksum")
+    }
+    return idx, nil
+}
+
+// buildCDCBody chunks a stream and writes the chunk list of a content defined index to output
+// return : in order of 'rootHash', 'blockcount', 'filesize', 'error'
+func buildCDCBody(input io.Reader, output io.Writer, params CDCParams, strongHash StrongHash) ([]byte, uint32, int64, error) {
+    var (
+        chunker   = newCDCChunker(input, params)
+        hasher    = strongHash.New()
+        chunkList []cdcChunk = nil
+        filesize  int64 = 0
+    )
+    for {
+        data, offset, err := chunker.next()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, 0, 0, err
+        }
+        hasher.Reset()
+        hasher.Write(data)
+        c := cdcChunk{offset: offset, length: uint32(len(data)), strong: hasher.Sum(nil)}
+        if err := writeCDCChunk(output, c); err != nil {
+            return nil, 0, 0, err
+        }
+        chunkList = append(chunkList, c)
+        filesize = offset + int64(len(data))
+    }
+    rootHash, err := cdcRootHash(chunkList)
+    if err != nil {
+        return nil, 0, 0, errors.WithStack(err)
+    }
+    return rootHash, uint32(len(chunkList)), filesize, nil
+}
+
+// cdcMatch chunks a local file with the index parameters, and returns the offset in the local file of every index
+// chunk found in it. offsets are -1 for chunks not found.
+func cdcMatch(local io.Reader, idx *cdcIndex, strongHash StrongHash) ([]int64, error) {
+    var (
+        chunker = newCDCChunker(bufio.NewReaderSize(local, mb), idx.params)
+        hasher  = strongHash.New()
+        found   = make([]int64, len(idx.chunks))
+    )
+    for i := range found {
+        found[i] = -1
+    }
+    for {
+        data, offset, err := chunker.next()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        hasher.Reset()
+        hasher.Write(data)
+        for _, id := range idx.byStrong[string(hasher.Sum(nil))] {
+            if found[id] < 0 && idx.chunks[id].length == uint32(len(data)) {
+                found[id] = offset
+            }
+        }
+    }
+    return found, nil
+}
+
+// merges the found chunks into spans of chunks that are contiguous in both the index and the local file
+func cdcFoundSpans(idx *cdcIndex, found []int64) []patcher.FoundBlockSpan {
+    var spans []patcher.FoundBlockSpan = nil
+    for id, offset := range found {
+        if offset < 0 {
+            continue
+        }
+        if n := len(spans); n != 0 {
+            last := &spans[n - 1]
+            _, spanEnd := idx.blockOffsets(last.EndBlock)
+            if last.EndBlock + 1 == uint(id) && last.MatchOffset + (spanEnd - idx.chunks[last.StartBlock].offset) == offset {
+                last.EndBlock = uint(id)
+                continue
+            }
+        }
+        spans = append(spans, patcher.FoundBlockSpan{
+            StartBlock:  uint(id),
+            EndBlock:    uint(id),
+            MatchOffset: offset,
+        })
+    }
+    return spans
+}
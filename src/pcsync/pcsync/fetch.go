@@ -0,0 +1,295 @@
+package pcsync
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/blocksources"
+    "github.com/Redundancy/go-sync/filechecksum"
+    "github.com/Redundancy/go-sync/patcher"
+)
+
+const (
+    // the amount of data requested from a repository at once
+    fetchRequestSize = 4 * mb
+    // the number of concurrent requests made against repositories
+    fetchWorkerCount = 4
+)
+
+// blockFetcher requests block ranges directly from the repositories and verifies them against index checksums.
+// unlike the multi-source patcher, it only fetches the spans it's asked for, and writes them at their offsets.
+type blockFetcher struct {
+    requesters []blocksources.BlockSourceRequester
+    lookup     filechecksum.ChecksumLookup
+    strongHash StrongHash
+    layout     blockLayout
+
+    // records every request to a repository
+    tracker    *sourceTracker
+    // requester ids in the order they're tried, and the ids sharing the requests, repeated by weight. empty tries them
+    // all in turn
+    order      []int
+    shares     []int
+}
+
+// SourceEvent reports a request of a block range to a repository
+type SourceEvent struct {
+    SourceID   int
+    Source     string
+    StartBlock uint
+    EndBlock   uint
+    // the byte range [Start, End) requested
+    Start      int64
+    End        int64
+    // the verified bytes received. zero when the request failed
+    Bytes      int64
+    Duration   time.Duration
+    Err        error
+    // the repository returned data that does not match the index
+    Corrupted  bool
+}
+
+// SourceFunc is called with every request made to a repository. calls are serialized.
+type SourceFunc func(SourceEvent)
+
+// returns the requester ids to try for a request, in order. 'first' picks the first one among the shares
+func (f *blockFetcher) attemptOrder(first int) []int {
+    var (
+        order  = f.order
+        shares = f.shares
+    )
+    if len(order) == 0 {
+        order = make([]int, len(f.requesters))
+        for i := range order {
+            order[i] = i
+        }
+    }
+    if len(shares) == 0 {
+        shares = order
+    }
+    k := shares[first % len(shares)]
+    attempts := []int{k}
+    for _, id := range order {
+        if id != k {
+            attempts = append(attempts, id)
+        }
+    }
+    return attempts
+}
+
+func (f *blockFetcher) record(event SourceEvent) {
+    if f.tracker != nil {
+        f.tracker.record(event)
+    }
+}
+
+// returns the byte range [start, end) covered by the block range
+func (f *blockFetcher) blockRangeOffsets(startBlock, endBlock uint) (int64, int64) {
+    return blockRangeOffsets(f.layout, startBlock, endBlock)
+}
+
+// returns the size of the reference file
+func (f *blockFetcher) filesize() int64 {
+    if f.layout.blockCount() == 0 {
+        return 0
+    }
+    _, end := f.layout.blockOffsets(f.layout.blockCount() - 1)
+    return end
+}
+
+// returns the number of blocks that make up about fetchRequestSize
+func (f *blockFetcher) blocksPerRequest() uint {
+    if f.layout.blockCount() == 0 {
+        return 1
+    }
+    average := f.filesize() / int64(f.layout.blockCount())
+    if average <= 0 || average >= fetchRequestSize {
+        return 1
+    }
+    return uint(fetchRequestSize / average)
+}
+
+// fetches the block range from the first repository that returns verified data.
+// 'first' rotates the starting repository among the preferred ones so concurrent requests are spread out.
+func (f *blockFetcher) fetchBlocks(startBlock, endBlock uint, first int) ([]byte, error) {
+    var (
+        start, end = f.blockRangeOffsets(startBlock, endBlock)
+        lastErr    error = nil
+    )
+    if len(f.requesters) == 0 {
+        return nil, errors.Errorf("no repository available to fetch blocks %v-%v", startBlock, endBlock)
+    }
+    for _, rID := range f.attemptOrder(first) {
+        var (
+            requested = time.Now()
+            event     = SourceEvent{SourceID: rID, StartBlock: startBlock, EndBlock: endBlock, Start: start, End: end}
+        )
+        data, err := f.requesters[rID].DoRequest(start, end)
+        event.Duration = time.Now().Sub(requested)
+        if err != nil {
+            log.Debugf("repository %v failed blocks %v-%v : %v", rID, startBlock, endBlock, err.Error())
+            lastErr = err
+        } else if int64(len(data)) != end-start {
+            lastErr = errors.Errorf("repository %v returned %v bytes for blocks %v-%v, expected %v", rID, len(data), startBlock, endBlock, end-start)
+            log.Debug(lastErr)
+            event.Corrupted = true
+        } else if bad := mismatchingBlocks(f.strongHash.New(), f.lookup, f.layout, startBlock, data); len(bad) != 0 {
+            lastErr = errors.Errorf("repository %v returned corrupted blocks %v", rID, bad)
+            log.Debug(lastErr)
+            event.Corrupted = true
+        } else {
+            event.Bytes = end - start
+            f.record(event)
+            return data, nil
+        }
+        event.Err = lastErr
+        f.record(event)
+    }
+    return nil, errors.WithMessage(lastErr, fmt.Sprintf("unable to fetch blocks %v-%v from any repository", startBlock, endBlock))
+}
+
+// splits missing spans into request sized block ranges
+func splitMissingSpans(spans []patcher.MissingBlockSpan, blocksPerRequest uint) []patcher.MissingBlockSpan {
+    var result []patcher.MissingBlockSpan = nil
+    if blocksPerRequest == 0 {
+        blocksPerRequest = 1
+    }
+    for _, s := range spans {
+        for b := s.StartBlock; b <= s.EndBlock; b += blocksPerRequest {
+            e := b + blocksPerRequest - 1
+            if e > s.EndBlock {
+                e = s.EndBlock
+            }
+            result = append(result, patcher.MissingBlockSpan{StartBlock: b, EndBlock: e, BlockSize: s.BlockSize})
+        }
+    }
+    return result
+}
+
+// fetches all the missing spans and writes them at their offset in output.
+// 'written' is called with each completed block range and its size in bytes. requests in flight when ctx is done are
+// let finish, and no more are made.
+func (f *blockFetcher) fetchSpansInto(ctx context.Context, output io.WriterAt, spans []patcher.MissingBlockSpan, written func(uint, uint, int64)) error {
+    var (
+        requests = splitMissingSpans(spans, f.blocksPerRequest())
+        queue    = make(chan int)
+        errOnce  sync.Once
+        firstErr error = nil
+        failed   int32 = 0
+        wg       sync.WaitGroup
+    )
+    for w := 0; w < fetchWorkerCount; w++ {
+        wg.Add(1)
+        go func(worker int) {
+            defer wg.Done()
+            for i := range queue {
+                if atomic.LoadInt32(&failed) != 0 {
+                    continue
+                }
+                r := requests[i]
+                if err := ctx.Err(); err != nil {
+                    errOnce.Do(func() {
+                        firstErr = err
+                        atomic.StoreInt32(&failed, 1)
+                    })
+                    continue
+                }
+                data, err := f.fetchBlocks(r.StartBlock, r.EndBlock, worker + i)
+                if err == nil {
+                    start, _ := f.blockRangeOffsets(r.StartBlock, r.EndBlock)
+                    _, err = output.WriteAt(data, start)
+                }
+                if err != nil {
+                    errOnce.Do(func() {
+                        firstErr = err
+                        atomic.StoreInt32(&failed, 1)
+                    })
+                    continue
+                }
+                written(r.StartBlock, r.EndBlock, int64(len(data)))
+            }
+        }(w)
+    }
+    for i := range requests {
+        queue <- i
+    }
+    close(queue)
+    wg.Wait()
+    return firstErr
+}
+
+// copies the found spans of the local file into output at their reference offsets. every block is checked against its
+// strong checksum before it's written, since the local file may have changed since it was matched.
+// return : the blocks that no longer match, which are left to fetch
+func (f *blockFetcher) copyFoundSpans(ctx context.Context, output io.WriterAt, local io.ReaderAt, spans []patcher.FoundBlockSpan, written func(uint, uint, int64)) ([]uint, error) {
+    var (
+        blocksPerCopy = f.blocksPerRequest()
+        hasher        = f.strongHash.New()
+        buf           []byte = nil
+        changed       []uint = nil
+    )
+    for _, s := range spans {
+        spanStart, _ := f.layout.blockOffsets(s.StartBlock)
+        for b := s.StartBlock; b <= s.EndBlock; b += blocksPerCopy {
+            e := b + blocksPerCopy - 1
+            if e > s.EndBlock {
+                e = s.EndBlock
+            }
+            if err := ctx.Err(); err != nil {
+                return nil, err
+            }
+            start, end := f.blockRangeOffsets(b, e)
+            n := end - start
+            if int64(len(buf)) < n {
+                buf = make([]byte, n)
+            }
+            if _, err := local.ReadAt(buf[:n], s.MatchOffset + (start - spanStart)); err != nil {
+                return nil, errors.WithStack(err)
+            }
+            // the runs of blocks between the ones that changed are written
+            bad := mismatchingBlocks(hasher, f.lookup, f.layout, b, buf[:n])
+            changed = append(changed, bad...)
+            runStart := b
+            for i := 0; i <= len(bad); i++ {
+                runEnd := e + 1
+                if i < len(bad) {
+                    runEnd = bad[i]
+                }
+                if runEnd > runStart {
+                    rs, re := f.blockRangeOffsets(runStart, runEnd - 1)
+                    if _, err := output.WriteAt(buf[rs - start:re - start], rs); err != nil {
+                        return nil, errors.WithStack(err)
+                    }
+                    written(runStart, runEnd - 1, re - rs)
+                }
+                runStart = runEnd + 1
+            }
+        }
+    }
+    return changed, nil
+}
+
+// ProgressFunc is called with the bytes of the output written so far, out of total. calls are serialized.
+type ProgressFunc func(written, total int64)
+
+// returns a function adding up written bytes and reporting them to progress, which may be nil
+func newProgressCounter(total int64, progress ProgressFunc) func(int64) {
+    var (
+        lock    sync.Mutex
+        written int64 = 0
+    )
+    return func(n int64) {
+        lock.Lock()
+        defer lock.Unlock()
+        written += n
+        if progress != nil {
+            progress(written, total)
+        }
+    }
+}
@@ -0,0 +1,494 @@
+/*
+Package pcsync reads, builds and writes .pcsync indexes, and patches, diffs, verifies and repairs files against them.
+It is the library behind the pcsync command, for services that sync images without shelling out to it.
+*/
+package pcsync
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "math"
+    "sort"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    gosync "github.com/Redundancy/go-sync"
+)
+
+const (
+    // one kilobyte
+    kb = 1024
+    // one megabyte
+    mb = 1000000
+
+    // the index format written by build. v0.2 indexes were versioned after the library
+    indexMajorVersion uint16 = 0
+    indexMinorVersion uint16 = 5
+    indexPatchVersion uint16 = 0
+    // the oldest minor version of the same major that can still be read
+    indexOldestMinorVersion uint16 = 2
+    // ends the index from v0.5
+    indexTrailerMagicString string = "PCSEND"
+
+    // limits on what an index header may ask a reader to allocate
+    maxIndexBlockSize     uint32 = 64 * mb
+    maxOptionalFieldsSize uint32 = 64 * kb
+    maxRootHashSize       uint32 = 64
+    // the block checksums of an 8KB block index of a 200GB file
+    maxIndexBodySize      int64 = 1000 * mb
+    // the blocks of an 8KB block index of a 256GB file. every block takes memory of its own once read, however small it is
+    maxIndexBlockCount    int64 = 1 << 25
+
+    // MaxIndexSize is the largest index a reader accepts : the fixed header fields, the optional fields and root hash
+    // at their limits, the block checksums and the trailer
+    MaxIndexSize int64 = int64(len(gosync.PocketSyncMagicString)) + 24 +
+        4 + int64(maxOptionalFieldsSize) +
+        4 + int64(maxRootHashSize) +
+        maxIndexBodySize +
+        int64(len(indexTrailerMagicString)) + 4
+)
+
+// Header holds the header fields of a .pcsync index
+type Header struct {
+    Major      uint16
+    Minor      uint16
+    Patch      uint16
+    FileSize   int64
+    // the block size, or the average chunk size of a content defined index
+    BlockSize  uint32
+    BlockCount uint32
+    StrongHash StrongHash
+    // content defined chunking bounds. nil for fixed size blocks
+    Chunking   *CDCParams
+    // optional fields by tag. fields unknown to this tool are kept as read
+    Optional   map[uint16][]byte
+    // the merkle root of the block strong checksums
+    RootHash   []byte
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// optional header field tags. tags with the critical bit set change how the index is read, so a reader that does not
+// know one must refuse the index rather than skip it.
+const (
+    optionalCriticalBit uint16 = 0x8000
+    // content defined chunking bounds : min, avg, max uint32 LE
+    optionalTagChunking uint16 = optionalCriticalBit | 1
+    // CRC-32C of the header, from v0.5. older readers skip it
+    optionalTagHeaderChecksum uint16 = 2
+)
+
+// blockLayout maps the blocks of an index (or the chunks of a content defined index) to their byte ranges
+type blockLayout interface {
+    blockCount() uint
+    // return : the byte range [start, end) of the block
+    blockOffsets(blockID uint) (int64, int64)
+}
+
+// fixedLayout is the layout of fixed size blocks. the last block may be short.
+type fixedLayout struct {
+    blocksize  int64
+    filesize   int64
+    blockcount uint
+}
+
+func (l fixedLayout) blockCount() uint {
+    return l.blockcount
+}
+
+func (l fixedLayout) blockOffsets(blockID uint) (int64, int64) {
+    start := int64(blockID) * l.blocksize
+    end := start + l.blocksize
+    if end > l.filesize {
+        end = l.filesize
+    }
+    return start, end
+}
+
+// returns the layout of a fixed block index header
+func (h *Header) fixedLayout() fixedLayout {
+    return fixedLayout{
+        blocksize:  int64(h.BlockSize),
+        filesize:   h.FileSize,
+        blockcount: uint(h.BlockCount),
+    }
+}
+
+// returns the byte range [start, end) covered by a block range
+func blockRangeOffsets(layout blockLayout, startBlock, endBlock uint) (int64, int64) {
+    start, _ := layout.blockOffsets(startBlock)
+    _, end := layout.blockOffsets(endBlock)
+    return start, end
+}
+
+// FormatError reports an index that is truncated, malformed or inconsistent with itself. I/O errors are returned as is,
+// and errors.Cause() of the errors returned by the readers tells them apart.
+type FormatError struct {
+    // the index field at fault
+    Field  string
+    Reason string
+}
+
+func (e *FormatError) Error() string {
+    return fmt.Sprintf("invalid index %v : %v", e.Field, e.Reason)
+}
+
+func newIndexFormatError(field, format string, args ...interface{}) error {
+    return errors.WithStack(&FormatError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+// reads a fixed size field, a []byte or a value for binary.Read. a short read is a truncated index.
+func readIndexField(r io.Reader, field string, data interface{}) error {
+    var err error = nil
+    if b, ok := data.([]byte); ok {
+        _, err = io.ReadFull(r, b)
+    } else {
+        err = binary.Read(r, binary.LittleEndian, data)
+    }
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return newIndexFormatError(field, "truncated")
+    }
+    return errors.WithStack(err)
+}
+
+// returns the size of a block entry in the index body
+func indexEntrySize(header *Header) int64 {
+    strongSize := int64(header.StrongHash.New().Size())
+    if header.Chunking != nil {
+        // offset int64, length uint32
+        return 12 + strongSize
+    }
+    return int64(newChecksumGenerator(uint(header.BlockSize), header.StrongHash).GetWeakRollingHash().Size()) + strongSize
+}
+
+// checks the header fields against each other before anything is allocated from them. the block count must be what
+// the file size and block size (or chunk size bounds) make, within maxIndexBlockCount, and the body must be within
+// maxIndexBodySize.
+func checkIndexHeader(header *Header) error {
+    var (
+        filesize   = header.FileSize
+        blockcount = int64(header.BlockCount)
+    )
+    if filesize < 0 {
+        return newIndexFormatError("filesize", "negative size %v", filesize)
+    }
+    if header.Chunking != nil {
+        var (
+            min = int64(header.Chunking.Min)
+            max = int64(header.Chunking.Max)
+        )
+        if header.BlockSize != header.Chunking.Avg {
+            return newIndexFormatError("blocksize", "%v differs from the average chunk size %v", header.BlockSize, header.Chunking.Avg)
+        }
+        // every chunk but the last is at least min long
+        fewest, most := (filesize + max - 1) / max, (filesize + min - 1) / min
+        if blockcount < fewest || blockcount > most {
+            return newIndexFormatError("blockcount", "%v chunks can't make %v bytes (min %v, max %v)", blockcount, filesize, min, max)
+        }
+    } else {
+        if header.BlockSize == 0 || header.BlockSize > maxIndexBlockSize {
+            return newIndexFormatError("blocksize", "%v is out of range (1-%v)", header.BlockSize, maxIndexBlockSize)
+        }
+        blocksize := int64(header.BlockSize)
+        if expected := (filesize + blocksize - 1) / blocksize; blockcount != expected {
+            return newIndexFormatError("blockcount", "%v, expected %v for %v bytes in %v byte blocks", blockcount, expected, filesize, blocksize)
+        }
+    }
+    if blockcount > maxIndexBlockCount {
+        return newIndexFormatError("blockcount", "%v is more than the limit of %v", blockcount, maxIndexBlockCount)
+    }
+    if size := blockcount * indexEntrySize(header); size > maxIndexBodySize {
+        return newIndexFormatError("blockcount", "%v blocks take %v bytes, more than the limit of %v", blockcount, size, maxIndexBodySize)
+    }
+    return nil
+}
+
+// checks the index version against the compatibility rules.
+// - the major version must be the same as the tool's.
+// - minor versions older than indexOldestMinorVersion have no reader.
+// - newer minor versions only add optional header fields, which are skipped.
+// - patch versions never change the layout.
+func checkIndexVersion(major, minor, patch uint16) error {
+    if major != indexMajorVersion {
+        return errors.Errorf("The acquired version (%v.%v.%v) is not compatible with the tool (%v.%v.%v). Major version differs.",
+            major, minor, patch,
+            indexMajorVersion, indexMinorVersion, indexPatchVersion)
+    }
+    if minor < indexOldestMinorVersion {
+        return errors.Errorf("The acquired version (%v.%v.%v) is older than the oldest supported version (%v.%v.0).",
+            major, minor, patch,
+            indexMajorVersion, indexOldestMinorVersion)
+    }
+    if minor > indexMinorVersion {
+        log.Debugf("index version %v.%v.%v is newer than the tool (%v.%v.%v). unknown optional fields are ignored",
+            major, minor, patch,
+            indexMajorVersion, indexMinorVersion, indexPatchVersion)
+    }
+    return nil
+}
+
+// writes the header in the current version of the format, whatever version it was read with
+func writeHeader(f io.Writer, header *Header) error {
+    optional := headerOptionalFields(header)
+    optional[optionalTagHeaderChecksum] = make([]byte, 4)
+    binary.LittleEndian.PutUint32(
+        optional[optionalTagHeaderChecksum],
+        headerChecksum(header, indexMajorVersion, indexMinorVersion, indexPatchVersion),
+    )
+    return writeHeaderFields(f, header, indexMajorVersion, indexMinorVersion, indexPatchVersion, optional)
+}
+
+// writes the header fields in order, with the given version and optional fields
+func writeHeaderFields(f io.Writer, header *Header, major, minor, patch uint16, optional map[uint16][]byte) error {
+    if _, err := io.WriteString(f, gosync.PocketSyncMagicString); err != nil {
+        return errors.WithStack(err)
+    }
+    for _, v := range []interface{}{
+        major,
+        minor,
+        patch,
+        header.FileSize,
+        header.BlockSize,
+        header.BlockCount,
+        uint16(header.StrongHash),
+    } {
+        if err := binary.Write(f, binary.LittleEndian, v); err != nil {
+            return errors.WithStack(err)
+        }
+    }
+    if err := writeOptionalFields(f, optional); err != nil {
+        return errors.WithStack(err)
+    }
+    var hLen uint32 = uint32(len(header.RootHash))
+    if err := binary.Write(f, binary.LittleEndian, hLen); err != nil {
+        return errors.WithStack(err)
+    }
+    if _, err := f.Write(header.RootHash); err != nil {
+        return errors.WithStack(err)
+    }
+    return nil
+}
+
+// returns the optional fields of the header as written : the fields kept as read, and the known fields
+func headerOptionalFields(header *Header) map[uint16][]byte {
+    optional := map[uint16][]byte{}
+    for tag, value := range header.Optional {
+        optional[tag] = value
+    }
+    if header.Chunking != nil {
+        optional[optionalTagChunking] = header.Chunking.marshal()
+    }
+    return optional
+}
+
+// the CRC-32C of the header written with the given version, and a zero header checksum field. the fields are hashed as
+// parsed, so a flipped bit anywhere in the header changes either a field or the checksum.
+func headerChecksum(header *Header, major, minor, patch uint16) uint32 {
+    var (
+        crc      = crc32.New(crc32cTable)
+        optional = headerOptionalFields(header)
+    )
+    optional[optionalTagHeaderChecksum] = make([]byte, 4)
+    // hashing can't fail, and the fields were within limits when read or built
+    writeHeaderFields(crc, header, major, minor, patch, optional)
+    return crc.Sum32()
+}
+
+// the trailer follows the body : the end marker, then the header checksum again, so a truncated index, or a body
+// followed by the trailer of another index, is refused.
+func writeTrailer(w io.Writer, header *Header) error {
+    if _, err := io.WriteString(w, indexTrailerMagicString); err != nil {
+        return errors.WithStack(err)
+    }
+    return errors.WithStack(binary.Write(w, binary.LittleEndian, headerChecksum(header, indexMajorVersion, indexMinorVersion, indexPatchVersion)))
+}
+
+// checks the trailer that follows the body from v0.5
+func readTrailer(r io.Reader, header *Header) error {
+    if header.Minor < 5 {
+        return nil
+    }
+    var (
+        bMagic   = make([]byte, len(indexTrailerMagicString))
+        checksum uint32 = 0
+    )
+    if err := readIndexField(r, "trailer", bMagic); err != nil {
+        return err
+    } else if string(bMagic) != indexTrailerMagicString {
+        return newIndexFormatError("trailer", "missing end marker")
+    }
+    if err := readIndexField(r, "trailer", &checksum); err != nil {
+        return err
+    }
+    if checksum != headerChecksum(header, header.Major, header.Minor, header.Patch) {
+        return newIndexFormatError("trailer", "the header checksum differs from the header's")
+    }
+    return nil
+}
+
+// optional fields are written as a total length (uint32), followed by (tag uint16, length uint16, value) entries in tag order
+func writeOptionalFields(w io.Writer, fields map[uint16][]byte) error {
+    var (
+        buf  = new(bytes.Buffer)
+        tags []int = nil
+    )
+    for t := range fields {
+        tags = append(tags, int(t))
+    }
+    sort.Ints(tags)
+    for _, t := range tags {
+        v := fields[uint16(t)]
+        if len(v) > math.MaxUint16 {
+            return errors.Errorf("optional header field %v is too long (%v bytes)", t, len(v))
+        }
+        binary.Write(buf, binary.LittleEndian, uint16(t))
+        binary.Write(buf, binary.LittleEndian, uint16(len(v)))
+        buf.Write(v)
+    }
+    if buf.Len() > int(maxOptionalFieldsSize) {
+        return errors.Errorf("optional header fields are too long (%v bytes)", buf.Len())
+    }
+    if err := binary.Write(w, binary.LittleEndian, uint32(buf.Len())); err != nil {
+        return errors.WithStack(err)
+    }
+    _, err := w.Write(buf.Bytes())
+    return errors.WithStack(err)
+}
+
+func readOptionalFields(r io.Reader) (map[uint16][]byte, error) {
+    var (
+        optLen uint32 = 0
+        fields = map[uint16][]byte{}
+    )
+    if err := readIndexField(r, "optional fields length", &optLen); err != nil {
+        return nil, err
+    }
+    if optLen > maxOptionalFieldsSize {
+        return nil, newIndexFormatError("optional fields length", "%v is more than the limit of %v", optLen, maxOptionalFieldsSize)
+    }
+    data := make([]byte, optLen)
+    if err := readIndexField(r, "optional fields", data); err != nil {
+        return nil, err
+    }
+    for len(data) > 0 {
+        if len(data) < 4 {
+            return nil, newIndexFormatError("optional fields", "truncated field")
+        }
+        tag := binary.LittleEndian.Uint16(data[0:2])
+        vLen := int(binary.LittleEndian.Uint16(data[2:4]))
+        if len(data) < 4 + vLen {
+            return nil, newIndexFormatError("optional fields", "truncated field %#x", tag)
+        }
+        if _, ok := fields[tag]; ok {
+            return nil, newIndexFormatError("optional fields", "duplicate field %#x", tag)
+        }
+        fields[tag] = data[4:4 + vLen]
+        data = data[4 + vLen:]
+    }
+    return fields, nil
+}
+
+// ReadHeader reads the file headers and checks the magic string, then the semantic versioning. each layout is read by
+// the fields the version introduced them with.
+// - v0.2 : no strong hash field. always MD5.
+// - v0.3 : strong hash algorithm.
+// - v0.4 : optional fields.
+// - v0.5 : a required header checksum field, and a trailer after the body.
+// a malformed or inconsistent header is a FormatError. nothing larger than the limits above is allocated.
+func ReadHeader(r io.Reader) (*Header, error) {
+    var (
+        bMagic []byte  = make([]byte, len(gosync.PocketSyncMagicString))
+        header *Header = &Header{StrongHash: StrongHashMD5}
+        hLen   uint32  = 0
+
+        checksum    uint32 = 0
+        hasChecksum        = false
+    )
+    // magic string
+    if err := readIndexField(r, "magic", bMagic); err != nil {
+        return nil, err
+    } else if string(bMagic) != gosync.PocketSyncMagicString {
+        return nil, newIndexFormatError("magic", "meta header does not confirm. Not a valid meta")
+    }
+
+    // version
+    for _, v := range []*uint16{&header.Major, &header.Minor, &header.Patch} {
+        if err := readIndexField(r, "version", v); err != nil {
+            return nil, err
+        }
+    }
+    if err := checkIndexVersion(header.Major, header.Minor, header.Patch); err != nil {
+        return nil, err
+    }
+
+    if err := readIndexField(r, "filesize", &header.FileSize); err != nil {
+        return nil, err
+    }
+    if err := readIndexField(r, "blocksize", &header.BlockSize); err != nil {
+        return nil, err
+    }
+    if err := readIndexField(r, "blockcount", &header.BlockCount); err != nil {
+        return nil, err
+    }
+    if header.Minor >= 3 {
+        if err := readIndexField(r, "strong hash", (*uint16)(&header.StrongHash)); err != nil {
+            return nil, err
+        }
+        if !header.StrongHash.IsValid() {
+            return nil, newIndexFormatError("strong hash", "unknown algorithm %v", uint16(header.StrongHash))
+        }
+    }
+    if header.Minor >= 4 {
+        optional, err := readOptionalFields(r)
+        if err != nil {
+            return nil, err
+        }
+        for tag, value := range optional {
+            switch tag {
+            case optionalTagChunking:
+                params, err := unmarshalCDCParams(value)
+                if err != nil {
+                    return nil, newIndexFormatError("chunking", "%v", err.Error())
+                }
+                header.Chunking = &params
+                delete(optional, tag)
+            case optionalTagHeaderChecksum:
+                if len(value) != 4 {
+                    return nil, newIndexFormatError("header checksum", "%v bytes, expected 4", len(value))
+                }
+                checksum, hasChecksum = binary.LittleEndian.Uint32(value), true
+                delete(optional, tag)
+            default:
+                if tag & optionalCriticalBit != 0 {
+                    return nil, newIndexFormatError("optional fields", "The index requires a feature (header field %#x) this tool does not support", tag)
+                }
+            }
+        }
+        header.Optional = optional
+    }
+    if err := readIndexField(r, "root hash length", &hLen); err != nil {
+        return nil, err
+    }
+    if hLen > maxRootHashSize {
+        return nil, newIndexFormatError("root hash length", "%v is more than the limit of %v", hLen, maxRootHashSize)
+    }
+    header.RootHash = make([]byte, hLen)
+    if err := readIndexField(r, "root hash", header.RootHash); err != nil {
+        return nil, err
+    }
+    if header.Minor >= 5 && !hasChecksum {
+        return nil, newIndexFormatError("header checksum", "missing")
+    }
+    if hasChecksum && checksum != headerChecksum(header, header.Major, header.Minor, header.Patch) {
+        return nil, newIndexFormatError("header checksum", "mismatching checksum. the header is corrupted")
+    }
+    // checked once the header is known to be intact, so corruption is reported as such
+    if err := checkIndexHeader(header); err != nil {
+        return nil, err
+    }
+    return header, nil
+}
+
@@ -0,0 +1,236 @@
+package pcsync
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    gosync "github.com/Redundancy/go-sync"
+    "github.com/Redundancy/go-sync/chunks"
+)
+
+// the fuzz targets start from the corpora of testdata/fuzz, and from the seeds below, built at run time so they match
+// the magic string and merkle root of the go-sync in use.
+
+func FuzzReadHeader(f *testing.F) {
+    for _, seed := range fuzzSeeds(f) {
+        f.Add(seed)
+    }
+    f.Fuzz(func(t *testing.T, data []byte) {
+        header, err := ReadHeader(bytes.NewReader(data))
+        if err != nil {
+            return
+        }
+        // a header that was read is written in the current version, and reads back the same
+        buf := new(bytes.Buffer)
+        if err := writeHeader(buf, header); err != nil {
+            if !optionalFieldsFit(header) {
+                return
+            }
+            t.Fatalf("unable to write a header that was read : %v", err)
+        }
+        again, err := ReadHeader(buf)
+        if err != nil {
+            t.Fatalf("the header written from %+v is refused : %v", header, err)
+        }
+        if !sameHeaderFields(header, again) {
+            t.Fatalf("the header read back %+v differs from %+v", again, header)
+        }
+    })
+}
+
+func FuzzReadIndex(f *testing.F) {
+    for _, seed := range fuzzSeeds(f) {
+        f.Add(seed)
+    }
+    f.Fuzz(func(t *testing.T, data []byte) {
+        idx, err := ReadIndex(bytes.NewReader(data))
+        if err != nil {
+            return
+        }
+        // an index that was read is written in the current version, and reads back the same
+        buf := new(bytes.Buffer)
+        if _, err := idx.WriteTo(buf); err != nil {
+            if !optionalFieldsFit(idx.header) {
+                return
+            }
+            t.Fatalf("unable to write an index that was read : %v", err)
+        }
+        again, err := ReadIndex(buf)
+        if err != nil {
+            t.Fatalf("the index written from %+v is refused : %v", idx.header, err)
+        }
+        if !sameHeaderFields(idx.header, again.header) || idx.layout.blockCount() != again.layout.blockCount() {
+            t.Fatalf("the index read back %+v differs from %+v", again.header, idx.header)
+        }
+        if buf.Len() != 0 {
+            t.Fatalf("%v bytes left after the index written", buf.Len())
+        }
+    })
+}
+
+// unknown optional fields are kept, so a header read at the limit may leave no room for the checksum field once written
+func optionalFieldsFit(header *Header) bool {
+    var (
+        optional = headerOptionalFields(header)
+        size     = 0
+    )
+    optional[optionalTagHeaderChecksum] = make([]byte, 4)
+    for _, value := range optional {
+        size += 4 + len(value)
+    }
+    return size <= int(maxOptionalFieldsSize)
+}
+
+// the header fields but the version, which is the current one once written
+func sameHeaderFields(a, b *Header) bool {
+    if a.FileSize != b.FileSize || a.BlockSize != b.BlockSize || a.BlockCount != b.BlockCount || a.StrongHash != b.StrongHash ||
+        !bytes.Equal(a.RootHash, b.RootHash) || (a.Chunking == nil) != (b.Chunking == nil) || len(a.Optional) != len(b.Optional) {
+        return false
+    }
+    if a.Chunking != nil && *a.Chunking != *b.Chunking {
+        return false
+    }
+    for tag, value := range a.Optional {
+        if !bytes.Equal(value, b.Optional[tag]) {
+            return false
+        }
+    }
+    return true
+}
+
+// named seeds : an index of every layout since v0.2, a content defined one, an index cut short in its body, one with a
+// block checksum that doesn't match its root hash and one with a header that doesn't match its checksum
+func fuzzSeeds(tb testing.TB) map[string][]byte {
+    var (
+        seeds  = map[string][]byte{}
+        header []byte = nil
+        body   []byte = nil
+    )
+    for minor := indexOldestMinorVersion; minor <= indexMinorVersion; minor++ {
+        header, body = fixedSeedIndex(tb, minor)
+        seeds[fmt.Sprintf("v%v.%v", indexMajorVersion, minor)] = append(append([]byte{}, header...), body...)
+    }
+
+    idx, err := Build(context.Background(), bytes.NewReader(seedData()), Options{BlockSize: cdcMinAverageSize, StrongHash: StrongHashSHA256, Chunking: ChunkingCDC})
+    if err != nil {
+        tb.Fatal(err)
+    }
+    cdc := new(bytes.Buffer)
+    if _, err := idx.WriteTo(cdc); err != nil {
+        tb.Fatal(err)
+    }
+    seeds[fmt.Sprintf("v%v.%v-cdc", indexMajorVersion, indexMinorVersion)] = cdc.Bytes()
+
+    // the current version, cut in the middle of its body
+    seeds["truncated-body"] = append(append([]byte{}, header...), body[:len(body) / 2]...)
+    // the current version, with the strong checksum of the last block, before the trailer, changed
+    corrupted := append(append([]byte{}, header...), body...)
+    corrupted[len(corrupted) - len(indexTrailerMagicString) - 4 - 1] ^= 1
+    seeds["bad-root-hash"] = corrupted
+    // the current version, with a file size that differs from the one the header checksum was computed with
+    corrupted = append(append([]byte{}, header...), body...)
+    corrupted[len(gosync.PocketSyncMagicString) + 6] ^= 1
+    seeds["bad-header-checksum"] = corrupted
+    return seeds
+}
+
+// a few blocks of text, the last one short
+func seedData() []byte {
+    return bytes.Repeat([]byte("pcsync fuzz seed data, in blocks of sixteen bytes. "), 20)
+}
+
+// returns the header and the body of an index of seedData in 16 byte blocks, laid out as the builds of v0.minor did
+func fixedSeedIndex(tb testing.TB, minor uint16) ([]byte, []byte) {
+    var (
+        data   = seedData()
+        header = &Header{Major: indexMajorVersion, Minor: minor, FileSize: int64(len(data)), BlockSize: 16, StrongHash: StrongHashSHA256}
+        list   chunks.SequentialChecksumList = nil
+        body   = new(bytes.Buffer)
+    )
+    // v0.2 indexes are always MD5
+    if minor < 3 {
+        header.StrongHash = StrongHashMD5
+    }
+    generator := newChecksumGenerator(uint(header.BlockSize), header.StrongHash)
+    for offset := 0; offset < len(data); offset += int(header.BlockSize) {
+        end := offset + int(header.BlockSize)
+        if end > len(data) {
+            end = len(data)
+        }
+        var (
+            block  = data[offset:end]
+            weak   = make([]byte, generator.GetWeakRollingHash().Size())
+            hasher = header.StrongHash.New()
+        )
+        generator.GetWeakRollingHash().SetBlock(block)
+        generator.GetWeakRollingHash().GetSum(weak)
+        hasher.Write(block)
+        list = append(list, chunks.ChunkChecksum{ChunkOffset: uint(len(list)), Size: int64(len(block)), WeakChecksum: weak, StrongChecksum: hasher.Sum(nil)})
+        body.Write(weak)
+        body.Write(list[len(list) - 1].StrongChecksum)
+    }
+    header.BlockCount = uint32(len(list))
+    rootHash, err := list.RootHash()
+    if err != nil {
+        tb.Fatal(err)
+    }
+    header.RootHash = rootHash
+
+    checksum := headerChecksum(header, header.Major, header.Minor, header.Patch)
+    if minor >= 5 {
+        body.WriteString(indexTrailerMagicString)
+        binary.Write(body, binary.LittleEndian, checksum)
+    }
+    return seedHeader(tb, header, checksum), body.Bytes()
+}
+
+// writes the header fields that v0.(header.Minor) has, in its layout
+func seedHeader(tb testing.TB, header *Header, checksum uint32) []byte {
+    var (
+        buf    = bytes.NewBufferString(gosync.PocketSyncMagicString)
+        fields = []interface{}{header.Major, header.Minor, header.Patch, header.FileSize, header.BlockSize, header.BlockCount}
+    )
+    if header.Minor >= 3 {
+        fields = append(fields, uint16(header.StrongHash))
+    }
+    for _, v := range fields {
+        binary.Write(buf, binary.LittleEndian, v)
+    }
+    if header.Minor >= 4 {
+        optional := headerOptionalFields(header)
+        if header.Minor >= 5 {
+            optional[optionalTagHeaderChecksum] = make([]byte, 4)
+            binary.LittleEndian.PutUint32(optional[optionalTagHeaderChecksum], checksum)
+        }
+        if err := writeOptionalFields(buf, optional); err != nil {
+            tb.Fatal(err)
+        }
+    }
+    binary.Write(buf, binary.LittleEndian, uint32(len(header.RootHash)))
+    buf.Write(header.RootHash)
+    return buf.Bytes()
+}
+
+// writes the seeds as the corpus of both fuzz targets, with PCSYNC_WRITE_CORPUS=1
+func TestWriteFuzzCorpus(t *testing.T) {
+    if os.Getenv("PCSYNC_WRITE_CORPUS") == "" {
+        t.Skip("set PCSYNC_WRITE_CORPUS=1 to rewrite testdata/fuzz")
+    }
+    for _, target := range []string{"FuzzReadHeader", "FuzzReadIndex"} {
+        dir := filepath.Join("testdata", "fuzz", target)
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            t.Fatal(err)
+        }
+        for name, seed := range fuzzSeeds(t) {
+            if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(fmt.Sprintf("go test fuzz v1\n[]byte(%q)\n", seed)), 0644); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+}
@@ -0,0 +1,253 @@
+package pcsync
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "runtime"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    gosync "github.com/Redundancy/go-sync"
+    "github.com/Redundancy/go-sync/blocksources"
+)
+
+const (
+    // the first wait before retrying a failed request. it doubles with every retry
+    defaultRetryBackoff = time.Duration(500) * time.Millisecond
+    // the longest wait between retries
+    maxRetryBackoff     = time.Duration(30) * time.Second
+)
+
+// HTTPOptions configure the http requests made to repositories and for remote indexes
+type HTTPOptions struct {
+    // the timeout of a request, for repositories that don't set their own, and of each read of a fetched file. 0 is 10s
+    Timeout   Duration `json:"timeout,omitempty"`
+    // the number of times a failed request is retried, with exponential backoff. client errors aren't retried
+    Retries   int      `json:"retries,omitempty"`
+    // the wait before the first retry. 0 is 500ms
+    Backoff   Duration `json:"backoff,omitempty"`
+    // empty is DefaultUserAgent()
+    UserAgent string   `json:"user_agent,omitempty"`
+    // the proxy url of every request. empty uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment
+    Proxy     string   `json:"proxy,omitempty"`
+    // a PEM bundle of certificate authorities trusted along with the system's
+    CAFile    string   `json:"ca_file,omitempty"`
+    // a PEM client certificate and its key, for repositories requiring one
+    CertFile  string   `json:"cert_file,omitempty"`
+    KeyFile   string   `json:"key_file,omitempty"`
+}
+
+// DefaultUserAgent names this version of pcsync and the platform it runs on
+func DefaultUserAgent() string {
+    return fmt.Sprintf("pcsync/%v.%v.%v (%v; %v)",
+        gosync.PocketSyncMajorVersion, gosync.PocketSyncMinorVersion, gosync.PocketSyncPatchVersion, runtime.GOOS, runtime.GOARCH)
+}
+
+// LoadHTTPOptions reads http options from a JSON file. a missing file leaves every option to its default.
+func LoadHTTPOptions(path string) (HTTPOptions, error) {
+    var opts HTTPOptions
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return opts, nil
+    } else if err != nil {
+        return opts, errors.WithStack(err)
+    }
+    if err := json.Unmarshal(data, &opts); err != nil {
+        return opts, errors.WithMessage(err, "invalid http configuration file " + path)
+    }
+    return opts, nil
+}
+
+// UserAgentString returns the user agent of the requests
+func (o HTTPOptions) UserAgentString() string {
+    if len(o.UserAgent) == 0 {
+        return DefaultUserAgent()
+    }
+    return o.UserAgent
+}
+
+// NewTransport returns a transport going through the proxy, and trusting the extra certificate authorities
+func (o HTTPOptions) NewTransport() (*http.Transport, error) {
+    var (
+        proxy     = http.ProxyFromEnvironment
+        tlsConfig = &tls.Config{}
+    )
+    if len(o.Proxy) != 0 {
+        proxyURL, err := url.Parse(o.Proxy)
+        if err != nil || len(proxyURL.Host) == 0 {
+            return nil, errors.Errorf("[ERR] invalid proxy url %v", o.Proxy)
+        }
+        proxy = http.ProxyURL(proxyURL)
+    }
+    if len(o.CAFile) != 0 {
+        pem, err := ioutil.ReadFile(o.CAFile)
+        if err != nil {
+            return nil, errors.WithStack(err)
+        }
+        // the system pool is unavailable on some platforms. the bundle is trusted alone then
+        pool, err := x509.SystemCertPool()
+        if err != nil || pool == nil {
+            pool = x509.NewCertPool()
+        }
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, errors.Errorf("[ERR] no certificate found in %v", o.CAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    if len(o.CertFile) != 0 || len(o.KeyFile) != 0 {
+        if len(o.CertFile) == 0 || len(o.KeyFile) == 0 {
+            return nil, errors.New("[ERR] a client certificate needs both its certificate and key files")
+        }
+        cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+        if err != nil {
+            return nil, errors.WithStack(err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    // the same settings as http.DefaultTransport
+    return &http.Transport{
+        Proxy: proxy,
+        DialContext: (&net.Dialer{
+            Timeout:   30 * time.Second,
+            KeepAlive: 30 * time.Second,
+        }).DialContext,
+        MaxIdleConns:          100,
+        IdleConnTimeout:       90 * time.Second,
+        TLSHandshakeTimeout:   10 * time.Second,
+        ExpectContinueTimeout: 1 * time.Second,
+        TLSClientConfig:       tlsConfig,
+    }, nil
+}
+
+// NewClient returns a client with the transport of NewTransport, and the given timeout for whole requests
+func (o HTTPOptions) NewClient(timeout time.Duration) (*http.Client, error) {
+    transport, err := o.NewTransport()
+    if err != nil {
+        return nil, err
+    }
+    return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// retryingRequester retries failed requests that aren't fatal, waiting longer every time
+type retryingRequester struct {
+    blocksources.BlockSourceRequester
+    retries int
+    backoff time.Duration
+}
+
+func (r *retryingRequester) DoRequest(start, end int64) ([]byte, error) {
+    wait := r.backoff
+    for attempt := 0; ; attempt++ {
+        data, err := r.BlockSourceRequester.DoRequest(start, end)
+        if err == nil || attempt >= r.retries || r.IsFatal(err) {
+            return data, err
+        }
+        log.Debugf("retrying bytes %v-%v in %v : %v", start, end - 1, wait, err.Error())
+        time.Sleep(wait)
+        wait = nextRetryBackoff(wait)
+    }
+}
+
+// doubles the wait before the next retry, up to maxRetryBackoff
+func nextRetryBackoff(wait time.Duration) time.Duration {
+    if wait *= 2; wait > maxRetryBackoff {
+        wait = maxRetryBackoff
+    }
+    return wait
+}
+
+// Fetch gets a whole remote file, such as an index or its signature, retrying failed requests as the repository requests
+// are. the timeout bounds the wait for the response and for each read of the body rather than the whole request, so a
+// large index isn't cut off while it's still coming in. the caller closes the body.
+func (o HTTPOptions) Fetch(url string) (io.ReadCloser, error) {
+    client, err := o.NewClient(0)
+    if err != nil {
+        return nil, err
+    }
+    var (
+        timeout = time.Duration(o.Timeout)
+        wait    = time.Duration(o.Backoff)
+    )
+    if timeout <= 0 {
+        timeout = defaultRepositoryTimeout
+    }
+    if wait <= 0 {
+        wait = defaultRetryBackoff
+    }
+    for attempt := 0; ; attempt++ {
+        body, err := fetchBody(client, url, o.UserAgentString(), timeout)
+        if err == nil || attempt >= o.Retries || isFatalHTTPError(err) {
+            return body, err
+        }
+        log.Debugf("retrying %v in %v : %v", url, wait, err.Error())
+        time.Sleep(wait)
+        wait = nextRetryBackoff(wait)
+    }
+}
+
+// requests the url, and returns its body once answered with a 2xx status
+func fetchBody(client *http.Client, url string, userAgent string, timeout time.Duration) (io.ReadCloser, error) {
+    ctx, cancel := context.WithCancel(context.Background())
+    req, err := http.NewRequest("GET", url, nil)
+    if err != nil {
+        cancel()
+        return nil, errors.WithStack(err)
+    }
+    req = req.WithContext(ctx)
+    req.Header.Set("User-Agent", userAgent)
+
+    // the request is cancelled when nothing was received within the timeout
+    idle := time.AfterFunc(timeout, cancel)
+    resp, err := client.Do(req)
+    idle.Stop()
+    if err != nil {
+        cancel()
+        if ctx.Err() != nil {
+            return nil, errors.Errorf("%v : no response within %v", url, timeout)
+        }
+        return nil, errors.WithStack(err)
+    }
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        resp.Body.Close()
+        cancel()
+        return nil, &httpStatusError{url: url, status: resp.Status, code: resp.StatusCode}
+    }
+    return &idleTimeoutBody{ReadCloser: resp.Body, url: url, ctx: ctx, cancel: cancel, idle: idle, timeout: timeout}, nil
+}
+
+// idleTimeoutBody cancels its request when a read waits longer than the timeout. the time spent between reads isn't
+// counted
+type idleTimeoutBody struct {
+    io.ReadCloser
+    url     string
+    ctx     context.Context
+    cancel  context.CancelFunc
+    idle    *time.Timer
+    timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+    b.idle.Reset(b.timeout)
+    n, err := b.ReadCloser.Read(p)
+    b.idle.Stop()
+    if err != nil && err != io.EOF && b.ctx.Err() != nil {
+        return n, errors.Errorf("%v : nothing received for %v", b.url, b.timeout)
+    }
+    return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+    b.idle.Stop()
+    b.cancel()
+    return b.ReadCloser.Close()
+}
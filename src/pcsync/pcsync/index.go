@@ -0,0 +1,213 @@
+package pcsync
+
+import (
+    "bufio"
+    "bytes"
+    "hash"
+    "io"
+
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/chunks"
+    "github.com/Redundancy/go-sync/filechecksum"
+    "github.com/Redundancy/go-sync/index"
+)
+
+// Index is a .pcsync index read or built in memory : the header, and the checksums of every block (or chunk).
+type Index struct {
+    header    *Header
+    // fixed size blocks
+    checksums []chunks.ChunkChecksum
+    index     *index.ChecksumIndex
+    // content defined chunks
+    cdc       *cdcIndex
+
+    lookup    filechecksum.ChecksumLookup
+    layout    blockLayout
+}
+
+// Block holds the checksums of an index block, as read. content defined chunks have no weak checksum.
+type Block struct {
+    ID     uint
+    Offset int64
+    Length int64
+    Weak   []byte
+    Strong []byte
+}
+
+// ReadIndex reads a whole index, and checks its block checksums against the root hash of the header, and the trailer.
+// a malformed index is a FormatError.
+func ReadIndex(r io.Reader) (*Index, error) {
+    header, err := ReadHeader(r)
+    if err != nil {
+        return nil, err
+    }
+    return readIndexBody(r, header)
+}
+
+func (idx *Index) Header() *Header {
+    return idx.header
+}
+
+// WeakCount returns the number of distinct weak checksums. content defined indexes have none.
+func (idx *Index) WeakCount() int {
+    if idx.index == nil {
+        return 0
+    }
+    return idx.index.WeakCount()
+}
+
+// WriteTo writes the index in the current version of the format
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+    var (
+        counter = &countingWriter{Writer: w}
+        out     = bufio.NewWriterSize(counter, mb)
+    )
+    if err := writeHeader(out, idx.header); err != nil {
+        return counter.count, err
+    }
+    if idx.cdc != nil {
+        for _, c := range idx.cdc.chunks {
+            if err := writeCDCChunk(out, c); err != nil {
+                return counter.count, err
+            }
+        }
+    } else {
+        for _, c := range idx.checksums {
+            out.Write(c.WeakChecksum)
+            out.Write(c.StrongChecksum)
+        }
+    }
+    if err := writeTrailer(out, idx.header); err != nil {
+        return counter.count, err
+    }
+    err := out.Flush()
+    return counter.count, errors.WithStack(err)
+}
+
+// reads the block checksums that follow the header, and checks them against the root hash
+func readIndexBody(rd io.Reader, header *Header) (*Index, error) {
+    if header.Chunking != nil {
+        cdcIdx, err := readCDCIndex(rd, header)
+        if err != nil {
+            return nil, err
+        }
+        if err := readTrailer(rd, header); err != nil {
+            return nil, err
+        }
+        return &Index{header: header, cdc: cdcIdx, lookup: cdcIdx, layout: cdcIdx}, nil
+    }
+
+    readChunks, err := readFixedChecksums(rd, header)
+    if err != nil {
+        return nil, err
+    }
+    if err := readTrailer(rd, header); err != nil {
+        return nil, err
+    }
+    idx := index.MakeChecksumIndex(readChunks)
+    cRootHash, err := idx.SequentialChecksumList().RootHash()
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if bytes.Compare(cRootHash, header.RootHash) != 0 {
+        return nil, newIndexFormatError("root hash", "[ERR] mismatching integrity checksum")
+    }
+
+    return &Index{
+        header:    header,
+        checksums: readChunks,
+        index:     idx,
+        lookup:    chunks.StrongChecksumGetter(readChunks),
+        layout:    header.fixedLayout(),
+    }, nil
+}
+
+func readFixedChecksums(rd io.Reader, header *Header) ([]chunks.ChunkChecksum, error) {
+    generator := newChecksumGenerator(uint(header.BlockSize), header.StrongHash)
+    readChunks, err := chunks.CountedLoadChecksumsFromReader(
+        rd,
+        uint(header.BlockCount),
+        generator.GetWeakRollingHash().Size(),
+        generator.GetStrongHash().Size(),
+    )
+    if cause := errors.Cause(err); cause == io.EOF || cause == io.ErrUnexpectedEOF {
+        return nil, newIndexFormatError("block checksums", "truncated")
+    } else if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if len(readChunks) != int(header.BlockCount) {
+        return nil, newIndexFormatError("block checksums", "%v blocks, expected %v", len(readChunks), header.BlockCount)
+    }
+    return readChunks, nil
+}
+
+// ReadBlocks reads the block checksums that follow the header as they are, for inspection.
+// return : the blocks, and the root hash they make, which may differ from the header's
+func ReadBlocks(rd io.Reader, header *Header) ([]Block, []byte, error) {
+    var blocks []Block = nil
+    if header.Chunking != nil {
+        chunkList, err := readCDCChunks(rd, header)
+        if err != nil {
+            return nil, nil, err
+        }
+        if err := readTrailer(rd, header); err != nil {
+            return nil, nil, err
+        }
+        for i, c := range chunkList {
+            blocks = append(blocks, Block{
+                ID:     uint(i),
+                Offset: c.offset,
+                Length: int64(c.length),
+                Strong: c.strong,
+            })
+        }
+        rootHash, err := cdcRootHash(chunkList)
+        return blocks, rootHash, errors.WithStack(err)
+    }
+
+    readChunks, err := readFixedChecksums(rd, header)
+    if err != nil {
+        return nil, nil, err
+    }
+    if err := readTrailer(rd, header); err != nil {
+        return nil, nil, err
+    }
+    layout := header.fixedLayout()
+    for i, c := range readChunks {
+        start, end := layout.blockOffsets(uint(i))
+        blocks = append(blocks, Block{
+            ID:     uint(i),
+            Offset: start,
+            Length: end - start,
+            Weak:   c.WeakChecksum,
+            Strong: c.StrongChecksum,
+        })
+    }
+    rootHash, err := chunks.SequentialChecksumList(readChunks).RootHash()
+    return blocks, rootHash, errors.WithStack(err)
+}
+
+// verifies data holding consecutive blocks, starting at startBlock, against the index strong checksums
+// return : ids of the blocks that do not match
+func mismatchingBlocks(hasher hash.Hash, lookup filechecksum.ChecksumLookup, layout blockLayout, startBlock uint, data []byte) []uint {
+    var (
+        bad        []uint = nil
+        base, _    = layout.blockOffsets(startBlock)
+    )
+    for b := startBlock; b < layout.blockCount(); b++ {
+        start, end := layout.blockOffsets(b)
+        if start - base >= int64(len(data)) {
+            break
+        }
+        if end - base > int64(len(data)) {
+            end = base + int64(len(data))
+        }
+        expected := lookup.GetStrongChecksumForBlock(int(b))
+        hasher.Reset()
+        hasher.Write(data[start - base:end - base])
+        if expected == nil || bytes.Compare(expected, hasher.Sum(nil)) != 0 {
+            bad = append(bad, b)
+        }
+    }
+    return bad
+}
@@ -0,0 +1,225 @@
+package pcsync
+
+import (
+    "bufio"
+    "encoding/base64"
+    "fmt"
+    "hash"
+    "io"
+    "os"
+    "sync"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/filechecksum"
+    "github.com/Redundancy/go-sync/patcher"
+)
+
+const (
+    journalSuffix string = ".pcsync-state"
+    journalMagic  string = "pcsync-state"
+    // how often the output is synced and completed ranges are appended to the journal
+    journalFlushInterval = time.Duration(2) * time.Second
+)
+
+// patchJournal is a sidecar file recording which block ranges of an output have been written and verified.
+//
+// The first line identifies the reference ("pcsync-state <filesize> <blocksize> <blockcount> <root hash>"), and each
+// following line holds a completed "<start block> <end block>" range. Ranges are only appended after the output has been
+// synced, so a torn last line or a crash can at most lose the most recent ranges.
+type patchJournal struct {
+    sync.Mutex
+    path      string
+    file      *os.File
+    output    *os.File
+    pending   [][2]uint
+    lastFlush time.Time
+}
+
+func journalPath(outFileName string) string {
+    return outFileName + journalSuffix
+}
+
+func journalHeader(filesize int64, blocksize, blockcount uint32, rootHash []byte) string {
+    return fmt.Sprintf("%v %v %v %v %v", journalMagic, filesize, blocksize, blockcount, base64.URLEncoding.EncodeToString(rootHash))
+}
+
+// reads the block ranges recorded for the same reference. a missing journal, or one for a different reference, yields no range.
+func readJournalRanges(path string, header string) ([][2]uint, error) {
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    } else if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer f.Close()
+
+    var (
+        scanner = bufio.NewScanner(f)
+        ranges  [][2]uint = nil
+    )
+    if !scanner.Scan() || scanner.Text() != header {
+        log.Infof("journal %v does not belong to this reference. starting over", path)
+        return nil, nil
+    }
+    for scanner.Scan() {
+        var start, end uint
+        if n, err := fmt.Sscanf(scanner.Text(), "%d %d", &start, &end); n != 2 || err != nil || end < start {
+            // torn write at the end of the journal
+            break
+        }
+        ranges = append(ranges, [2]uint{start, end})
+    }
+    return ranges, nil
+}
+
+// validates the block ranges recorded in the journal against the output, and returns the blocks that are already done.
+func validateJournalRanges(output io.ReaderAt, ranges [][2]uint, lookup filechecksum.ChecksumLookup, hasher hash.Hash, layout blockLayout) ([]bool, error) {
+    var (
+        done = make([]bool, layout.blockCount())
+        buf  []byte = nil
+    )
+    for _, r := range ranges {
+        for b := r[0]; b <= r[1] && b < layout.blockCount(); b++ {
+            if done[b] {
+                continue
+            }
+            start, end := layout.blockOffsets(b)
+            if int64(len(buf)) < end-start {
+                buf = make([]byte, end-start)
+            }
+            n, err := output.ReadAt(buf[:end-start], start)
+            if err != nil && err != io.EOF {
+                return nil, errors.WithStack(err)
+            }
+            if int64(n) == end-start && len(mismatchingBlocks(hasher, lookup, layout, b, buf[:n])) == 0 {
+                done[b] = true
+            }
+        }
+    }
+    return done, nil
+}
+
+// creates a new journal, discarding the previous one, and records the blocks that are already done.
+func createJournal(path string, header string, output *os.File, done []bool) (*patchJournal, error) {
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    j := &patchJournal{
+        path:      path,
+        file:      f,
+        output:    output,
+        lastFlush: time.Now(),
+    }
+    if _, err := fmt.Fprintln(f, header); err != nil {
+        f.Close()
+        return nil, errors.WithStack(err)
+    }
+    for _, s := range blockRanges(done, true) {
+        j.pending = append(j.pending, [2]uint{s.StartBlock, s.EndBlock})
+    }
+    if err := j.flush(); err != nil {
+        f.Close()
+        return nil, err
+    }
+    return j, nil
+}
+
+// records a written and verified block range. ranges are flushed periodically.
+func (j *patchJournal) record(startBlock, endBlock uint) error {
+    j.Lock()
+    defer j.Unlock()
+    j.pending = append(j.pending, [2]uint{startBlock, endBlock})
+    if time.Now().Sub(j.lastFlush) < journalFlushInterval {
+        return nil
+    }
+    return j.flushLocked()
+}
+
+func (j *patchJournal) flush() error {
+    j.Lock()
+    defer j.Unlock()
+    return j.flushLocked()
+}
+
+func (j *patchJournal) flushLocked() error {
+    j.lastFlush = time.Now()
+    if len(j.pending) == 0 {
+        return nil
+    }
+    // data must be on disk before the journal claims it is
+    if err := j.output.Sync(); err != nil {
+        return errors.WithStack(err)
+    }
+    w := bufio.NewWriter(j.file)
+    for _, r := range j.pending {
+        fmt.Fprintf(w, "%d %d\n", r[0], r[1])
+    }
+    if err := w.Flush(); err != nil {
+        return errors.WithStack(err)
+    }
+    j.pending = nil
+    return errors.WithStack(j.file.Sync())
+}
+
+// flushes the pending ranges and closes the journal. the journal is kept for the next run to resume from.
+func (j *patchJournal) Close() error {
+    err := j.flush()
+    if cerr := j.file.Close(); err == nil && cerr != nil {
+        err = errors.WithStack(cerr)
+    }
+    return err
+}
+
+// closes and removes the journal once the output is complete
+func (j *patchJournal) Remove() error {
+    j.Lock()
+    j.pending = nil
+    j.Unlock()
+    j.file.Close()
+    return errors.WithStack(os.Remove(j.path))
+}
+
+// returns the contiguous block ranges whose state in blocks equals 'state'
+func blockRanges(blocks []bool, state bool) []patcher.MissingBlockSpan {
+    var (
+        spans []patcher.MissingBlockSpan = nil
+        start = -1
+    )
+    for i, b := range blocks {
+        if b == state && start < 0 {
+            start = i
+        } else if b != state && start >= 0 {
+            spans = append(spans, patcher.MissingBlockSpan{StartBlock: uint(start), EndBlock: uint(i - 1)})
+            start = -1
+        }
+    }
+    if start >= 0 {
+        spans = append(spans, patcher.MissingBlockSpan{StartBlock: uint(start), EndBlock: uint(len(blocks) - 1)})
+    }
+    return spans
+}
+
+// removes the blocks that are already done from the found spans, adjusting the match offsets accordingly
+func filterFoundSpans(found []patcher.FoundBlockSpan, done []bool, layout blockLayout) []patcher.FoundBlockSpan {
+    var result []patcher.FoundBlockSpan = nil
+    for _, s := range found {
+        sub := make([]bool, s.EndBlock - s.StartBlock + 1)
+        for b := s.StartBlock; b <= s.EndBlock; b++ {
+            sub[b - s.StartBlock] = int(b) < len(done) && !done[b]
+        }
+        spanStart, _ := layout.blockOffsets(s.StartBlock)
+        for _, r := range blockRanges(sub, true) {
+            start, _ := layout.blockOffsets(s.StartBlock + r.StartBlock)
+            result = append(result, patcher.FoundBlockSpan{
+                StartBlock:  s.StartBlock + r.StartBlock,
+                EndBlock:    s.StartBlock + r.EndBlock,
+                BlockSize:   s.BlockSize,
+                MatchOffset: s.MatchOffset + (start - spanStart),
+            })
+        }
+    }
+    return result
+}
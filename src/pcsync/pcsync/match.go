@@ -0,0 +1,316 @@
+package pcsync
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "time"
+
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/comparer"
+    "github.com/Redundancy/go-sync/index"
+    "github.com/Redundancy/go-sync/patcher"
+)
+
+// DiffResult holds the statistics of matching a local file against an index. byte counts are exact, the last block
+// of fixed size indexes counting for its actual size.
+type DiffResult struct {
+    IndexBlocks    uint
+    MatchedBlocks  uint
+    MatchedBytes   int64
+    MissingBlocks  uint
+    MissingBytes   int64
+    // the block ranges of the index found in the local file, in index order
+    Matched        []MatchedRange
+    // the block ranges of the index missing from the local file, in index order
+    Missing        []BlockRange
+
+    // the rolling hash statistics of fixed size blocks
+    Comparisons    int64
+    WeakHashHits   int64
+    StrongHashHits int64
+    // the time spent matching
+    Duration       time.Duration
+}
+
+// MatchedRange is a range of consecutive index blocks found at LocalOffset in the local file
+type MatchedRange struct {
+    BlockRange
+    LocalOffset int64
+}
+
+// Diff finds the blocks of the index present anywhere in the local file, using up to 'matchers' concurrent matchers.
+// Content defined indexes are matched by chunking the local file with the index parameters instead.
+func Diff(ctx context.Context, local io.ReaderAt, localSize int64, idx *Index, matchers int) (*DiffResult, error) {
+    return diff(ctx, local, localSize, idx, matchers, maxMatchSectionSize)
+}
+
+// Diff, with the largest section a matcher takes from the queue
+func diff(ctx context.Context, local io.ReaderAt, localSize int64, idx *Index, matchers int, maxSectionSize int64) (*DiffResult, error) {
+    var (
+        header = idx.header
+        result = &DiffResult{IndexBlocks: idx.layout.blockCount()}
+        start  = time.Now()
+        // the local offset of every index block, -1 when it's missing
+        found  []int64 = nil
+        err    error = nil
+    )
+    if idx.cdc != nil {
+        found, err = cdcMatch(&contextReader{ctx: ctx, Reader: io.NewSectionReader(local, 0, localSize)}, idx.cdc, header.StrongHash)
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        merger, compare, failed := multithreadedMatching(
+            ctx,
+            local,
+            idx.index,
+            localSize,
+            int64(matchers),
+            uint(header.BlockSize),
+            header.StrongHash,
+            maxSectionSize,
+        )
+        mergedBlocks := merger.GetMergedBlocks()
+        if err := <-failed; err != nil {
+            return nil, err
+        }
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        result.Comparisons = compare.Comparisons
+        result.WeakHashHits = compare.WeakHashHits
+        result.StrongHashHits = compare.StrongHashHits
+
+        found = make([]int64, result.IndexBlocks)
+        for i := range found {
+            found[i] = -1
+        }
+        for _, s := range toPatcherFoundSpan(mergedBlocks, int64(header.BlockSize)) {
+            spanStart, _ := idx.layout.blockOffsets(s.StartBlock)
+            for b := s.StartBlock; b <= s.EndBlock && b < result.IndexBlocks; b++ {
+                blockStart, _ := idx.layout.blockOffsets(b)
+                found[b] = s.MatchOffset + (blockStart - spanStart)
+            }
+        }
+    }
+    diffRanges(result, idx.layout, found)
+    result.Duration = time.Now().Sub(start)
+    return result, nil
+}
+
+// fills the matched and missing ranges, and their counts, from the local offset of every block. consecutive blocks found
+// consecutively in the local file make a range.
+func diffRanges(result *DiffResult, layout blockLayout, found []int64) {
+    var (
+        missing = make([]bool, len(found))
+        next    int64 = -1
+    )
+    for b, offset := range found {
+        start, end := layout.blockOffsets(uint(b))
+        if offset < 0 {
+            missing[b] = true
+            result.MissingBlocks++
+            result.MissingBytes += end - start
+            next = -1
+            continue
+        }
+        result.MatchedBlocks++
+        result.MatchedBytes += end - start
+        if last := len(result.Matched) - 1; last >= 0 && offset == next {
+            result.Matched[last].EndBlock = uint(b)
+            result.Matched[last].End = end
+        } else {
+            result.Matched = append(result.Matched, MatchedRange{
+                BlockRange:  BlockRange{StartBlock: uint(b), EndBlock: uint(b), Start: start, End: end},
+                LocalOffset: offset,
+            })
+        }
+        next = offset + (end - start)
+    }
+    for _, r := range blockRanges(missing, true) {
+        start, end := blockRangeOffsets(layout, r.StartBlock, r.EndBlock)
+        result.Missing = append(result.Missing, BlockRange{StartBlock: r.StartBlock, EndBlock: r.EndBlock, Start: start, End: end})
+    }
+}
+
+const (
+    // the largest section of the local file a matcher takes from the queue
+    maxMatchSectionSize int64 = 16 * mb
+    // the sections matched ahead of the oldest section not merged yet, per matcher
+    matchSectionsAhead = 4
+)
+
+// matchSection is a block aligned section of the local file. matches are reported for the windows starting in
+// [offset, offset + size), so the section reads blocksize - 1 bytes past its end.
+type matchSection struct {
+    offset  int64
+    size    int64
+    results chan []comparer.BlockMatchResult
+    // why the section failed to read. set before its results are sent
+    err     error
+}
+
+// matches the local file against the index with up to matcherCount concurrent matchers. the file is divided into many
+// sections pulled from a queue, so matchers finishing early take more of the work, and their results are merged in file
+// order. sections are at most maxSectionSize, and stop reading once ctx is done, or once a section failed to read.
+// return : the merger, the comparer statistics, and the channel receiving the first section error, or nil, once merged
+func multithreadedMatching(
+    ctx            context.Context,
+    localFile      io.ReaderAt,
+    idx            *index.ChecksumIndex,
+    localFileSize  int64,
+    matcherCount   int64,
+    blocksize      uint,
+    strongHash     StrongHash,
+    maxSectionSize int64,
+) (*comparer.MatchMerger, *comparer.Comparer, <-chan error) {
+    // Don't split up small files
+    if matcherCount < 1 || localFileSize < 1024*1024 {
+        matcherCount = 1
+    }
+    var (
+        bs          = int64(blocksize)
+        sectionSize = (localFileSize + matcherCount - 1) / matcherCount
+        merger      = &comparer.MatchMerger{}
+        compare     = &comparer.Comparer{}
+        sections    []*matchSection = nil
+    )
+    if sectionSize > maxSectionSize {
+        sectionSize = maxSectionSize
+    }
+    if rest := sectionSize % bs; rest != 0 || sectionSize == 0 {
+        sectionSize += bs - rest
+    }
+    for offset := int64(0); offset == 0 || offset < localFileSize; offset += sectionSize {
+        sections = append(sections, &matchSection{offset: offset, size: sectionSize, results: make(chan []comparer.BlockMatchResult, 1)})
+    }
+    if int64(len(sections)) < matcherCount {
+        matcherCount = int64(len(sections))
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    var (
+        queue = make(chan *matchSection)
+        // a section is queued once there's room ahead of the merge, which bounds the results held in memory
+        ahead = make(chan struct{}, matcherCount * matchSectionsAhead)
+    )
+    go func() {
+        defer close(queue)
+        for _, section := range sections {
+            select {
+            case ahead <- struct{}{}:
+            case <-ctx.Done():
+                // the matchers report the remaining sections empty
+            }
+            queue <- section
+        }
+    }()
+    for i := int64(0); i < matcherCount; i++ {
+        go func() {
+            for section := range queue {
+                var results []comparer.BlockMatchResult
+                results, section.err = matchSectionBlocks(ctx, localFile, localFileSize, section, idx, compare, blocksize, strongHash)
+                section.results <- results
+            }
+        }()
+    }
+
+    // the merger takes a single stream, in file order
+    var (
+        ordered = make(chan comparer.BlockMatchResult)
+        failed  = make(chan error, 1)
+    )
+    go func() {
+        var firstErr error = nil
+        defer func() {
+            failed <- firstErr
+            close(ordered)
+            cancel()
+        }()
+        for _, section := range sections {
+            for _, result := range <-section.results {
+                ordered <- result
+            }
+            // the sections left stop reading. the first error is the one that counts
+            if section.err != nil && firstErr == nil {
+                firstErr = section.err
+                cancel()
+            }
+            select {
+            case <-ahead:
+            default:
+            }
+        }
+    }()
+    merger.StartMergeResultStream(ordered, bs)
+
+    return merger, compare, failed
+}
+
+// finds the index blocks at the windows starting in the section
+func matchSectionBlocks(
+    ctx           context.Context,
+    localFile     io.ReaderAt,
+    localFileSize int64,
+    section       *matchSection,
+    idx           *index.ChecksumIndex,
+    compare       *comparer.Comparer,
+    blocksize     uint,
+    strongHash    StrongHash,
+) ([]comparer.BlockMatchResult, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    size := section.size + int64(blocksize) - 1
+    if section.offset + size > localFileSize {
+        size = localFileSize - section.offset
+    }
+    sectionReader := bufio.NewReaderSize(
+        &contextReader{ctx: ctx, Reader: io.NewSectionReader(localFile, section.offset, size)},
+        mb,
+    )
+    var (
+        results []comparer.BlockMatchResult = nil
+        err     error = nil
+    )
+    for result := range compare.StartFindMatchingBlocks(sectionReader, section.offset, newChecksumGenerator(blocksize, strongHash), idx) {
+        // the matches found before a read error are kept, the match fails anyway
+        if result.Err != nil {
+            if err == nil {
+                err = errors.WithMessage(result.Err, fmt.Sprintf("unable to read bytes %v-%v", section.offset, section.offset + size - 1))
+            }
+            continue
+        }
+        results = append(results, result)
+    }
+    return results, err
+}
+
+// better way to do this?
+
+func toPatcherFoundSpan(sl comparer.BlockSpanList, blockSize int64) []patcher.FoundBlockSpan {
+    result := make([]patcher.FoundBlockSpan, len(sl))
+
+    for i, v := range sl {
+        result[i].StartBlock = v.StartBlock
+        result[i].EndBlock = v.EndBlock
+        result[i].MatchOffset = v.ComparisonStartOffset
+        result[i].BlockSize = blockSize
+    }
+
+    return result
+}
+
+func toPatcherMissingSpan(sl comparer.BlockSpanList, blockSize int64) []patcher.MissingBlockSpan {
+    result := make([]patcher.MissingBlockSpan, len(sl))
+
+    for i, v := range sl {
+        result[i].StartBlock = v.StartBlock
+        result[i].EndBlock = v.EndBlock
+        result[i].BlockSize = blockSize
+    }
+
+    return result
+}
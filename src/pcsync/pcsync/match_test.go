@@ -0,0 +1,66 @@
+package pcsync
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "math/rand"
+    "testing"
+)
+
+// BenchmarkDiff compares the queue of sections Diff matches with, against one section per matcher, where a matcher
+// done early waits for the others. the 256MB files are left out with -short.
+func BenchmarkDiff(b *testing.B) {
+    for _, size := range []int64{64 * mb, 256 * mb} {
+        b.Run(fmt.Sprintf("size=%vMB", size / mb), func(b *testing.B) {
+            if size > 64 * mb && testing.Short() {
+                b.Skip("skipping the larger files in short mode")
+            }
+            // the files of a size are only allocated while its benchmarks run
+            reference, local := benchmarkDiffFiles(size)
+            idx, err := Build(context.Background(), bytes.NewReader(reference), Options{BlockSize: 8 * kb, StrongHash: DefaultStrongHash})
+            if err != nil {
+                b.Fatal(err)
+            }
+            for _, matchers := range []int{2, 4} {
+                for _, mode := range []struct {
+                    name           string
+                    maxSectionSize int64
+                }{
+                    {"queue", maxMatchSectionSize},
+                    {"section-per-matcher", size},
+                } {
+                    b.Run(fmt.Sprintf("p=%v/%v", matchers, mode.name), func(b *testing.B) {
+                        b.SetBytes(size)
+                        b.ResetTimer()
+                        for i := 0; i < b.N; i++ {
+                            if _, err := diff(context.Background(), bytes.NewReader(local), size, idx, matchers, mode.maxSectionSize); err != nil {
+                                b.Fatal(err)
+                            }
+                        }
+                    })
+                }
+            }
+        })
+    }
+}
+
+// returns a reference file of random data, and a local copy with a run of changed bytes every 4MB, longer towards the
+// end of the file. changed bytes are matched byte by byte and the others block by block, so the sections don't all take
+// as long
+func benchmarkDiffFiles(size int64) ([]byte, []byte) {
+    var (
+        random    = rand.New(rand.NewSource(size))
+        reference = make([]byte, size)
+    )
+    random.Read(reference)
+    local := append([]byte{}, reference...)
+    for offset := int64(0); offset < size; offset += 4 * mb {
+        n := 64 * kb + 2 * mb * offset / size
+        if offset + n > size {
+            n = size - offset
+        }
+        random.Read(local[offset:offset + n])
+    }
+    return reference, local
+}
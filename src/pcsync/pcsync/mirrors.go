@@ -0,0 +1,231 @@
+package pcsync
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "math"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+)
+
+const (
+    // the weight of the latest run in the mirror score averages
+    mirrorScoreWeight = 0.3
+    // mirrors scoring at least this fraction of the best score share the requests. the others are fallbacks
+    mirrorPreferredRatio = 0.5
+)
+
+// SourceStats counts the requests made to a repository during an operation
+type SourceStats struct {
+    SourceID       int
+    Source         string
+    // the verified bytes served
+    Bytes          int64
+    Requests       int
+    // the blocks of every request, including failed ones
+    Blocks         int64
+    // failed requests, including verification failures
+    Failures       int
+    // requests answered with data that does not match the index
+    VerifyFailures int
+    // the total time spent in requests
+    Latency        time.Duration
+}
+
+// AverageLatency returns the average time of a request
+func (s SourceStats) AverageLatency() time.Duration {
+    if s.Requests == 0 {
+        return 0
+    }
+    return s.Latency / time.Duration(s.Requests)
+}
+
+// sourceTracker keeps the stats of every repository, and forwards the request events
+type sourceTracker struct {
+    lock     sync.Mutex
+    stats    []SourceStats
+    onSource SourceFunc
+}
+
+func newSourceTracker(sources []string, onSource SourceFunc) *sourceTracker {
+    t := &sourceTracker{stats: make([]SourceStats, len(sources)), onSource: onSource}
+    for i, src := range sources {
+        t.stats[i].SourceID, t.stats[i].Source = i, src
+    }
+    return t
+}
+
+func (t *sourceTracker) record(event SourceEvent) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    if event.SourceID < 0 || event.SourceID >= len(t.stats) {
+        return
+    }
+    s := &t.stats[event.SourceID]
+    event.Source = s.Source
+    s.Requests++
+    s.Blocks += int64(event.EndBlock - event.StartBlock + 1)
+    s.Latency += event.Duration
+    if event.Err != nil {
+        s.Failures++
+        if event.Corrupted {
+            s.VerifyFailures++
+        }
+    } else {
+        s.Bytes += event.Bytes
+    }
+    if t.onSource != nil {
+        t.onSource(event)
+    }
+}
+
+func (t *sourceTracker) snapshot() []SourceStats {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    return append([]SourceStats(nil), t.stats...)
+}
+
+// MirrorScore is the record of a repository over past runs. the rates and speeds are exponentially weighted averages.
+type MirrorScore struct {
+    // bytes per second of request time
+    Throughput  float64   `json:"throughput"`
+    LatencyMs   float64   `json:"latency_ms"`
+    FailureRate float64   `json:"failure_rate"`
+    CorruptRate float64   `json:"corrupt_rate"`
+    Runs        int       `json:"runs"`
+    Updated     time.Time `json:"updated"`
+}
+
+// Score ranks the mirror. faster is better, and failing or corrupted requests bring it down, corruption twice as much.
+func (m *MirrorScore) Score() float64 {
+    return m.Throughput * (1 - m.FailureRate) * math.Pow(1 - m.CorruptRate, 2)
+}
+
+// MirrorScores keeps the records of repositories by source url, carried across runs in a state file
+type MirrorScores struct {
+    lock    sync.Mutex
+    Mirrors map[string]*MirrorScore `json:"mirrors"`
+}
+
+// LoadMirrorScores reads a mirror state file. a missing file has no records.
+func LoadMirrorScores(path string) (*MirrorScores, error) {
+    scores := &MirrorScores{Mirrors: map[string]*MirrorScore{}}
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return scores, nil
+    } else if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if err := json.Unmarshal(data, scores); err != nil {
+        return nil, errors.WithMessage(err, "invalid mirror state file " + path)
+    }
+    if scores.Mirrors == nil {
+        scores.Mirrors = map[string]*MirrorScore{}
+    }
+    return scores, nil
+}
+
+// Save writes the state file, replacing the previous one at once. the file is written to a temporary file of its own
+// first, so runs saving at the same time never mix their records : the last one to save wins, and the records of the
+// others are lost.
+func (m *MirrorScores) Save(path string) error {
+    m.lock.Lock()
+    data, err := json.MarshalIndent(m, "", "  ")
+    m.lock.Unlock()
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    dir := filepath.Dir(path)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return errors.WithStack(err)
+    }
+    tmp, err := ioutil.TempFile(dir, filepath.Base(path) + ".tmp")
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    _, err = tmp.Write(data)
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        // TempFile creates the file readable by its owner only
+        err = os.Chmod(tmp.Name(), 0644)
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return errors.WithStack(err)
+    }
+    return nil
+}
+
+// Update adds the stats of a run to the records. repositories that weren't requested are left as they are.
+func (m *MirrorScores) Update(stats []SourceStats) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    for _, s := range stats {
+        if s.Requests == 0 {
+            continue
+        }
+        var (
+            throughput  = 0.0
+            latencyMs   = float64(s.AverageLatency()) / float64(time.Millisecond)
+            failureRate = float64(s.Failures) / float64(s.Requests)
+            corruptRate = float64(s.VerifyFailures) / float64(s.Requests)
+        )
+        if s.Latency > 0 {
+            throughput = float64(s.Bytes) / s.Latency.Seconds()
+        }
+        record, ok := m.Mirrors[s.Source]
+        if !ok {
+            record = &MirrorScore{Throughput: throughput, LatencyMs: latencyMs, FailureRate: failureRate, CorruptRate: corruptRate}
+            m.Mirrors[s.Source] = record
+        } else {
+            average := func(previous, latest float64) float64 {
+                return previous * (1 - mirrorScoreWeight) + latest * mirrorScoreWeight
+            }
+            record.Throughput = average(record.Throughput, throughput)
+            record.LatencyMs = average(record.LatencyMs, latencyMs)
+            record.FailureRate = average(record.FailureRate, failureRate)
+            record.CorruptRate = average(record.CorruptRate, corruptRate)
+        }
+        record.Runs++
+        record.Updated = time.Now().UTC()
+    }
+}
+
+// returns the score of every source. sources without a record score as the best one, so new mirrors get tried.
+// a nil MirrorScores has no scores.
+func (m *MirrorScores) scores(sources []string) []float64 {
+    if m == nil {
+        return nil
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    var (
+        scores = make([]float64, len(sources))
+        best   = 0.0
+        known  = false
+    )
+    for i, src := range sources {
+        if record, ok := m.Mirrors[src]; ok {
+            scores[i] = record.Score()
+            if !known || scores[i] > best {
+                best, known = scores[i], true
+            }
+        }
+    }
+    for i, src := range sources {
+        if _, ok := m.Mirrors[src]; !ok {
+            scores[i] = best
+        }
+    }
+    return scores
+}
@@ -0,0 +1,356 @@
+package pcsync
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/blocksources"
+    "github.com/Redundancy/go-sync/patcher"
+)
+
+const (
+    // the reference is written next to the output, and renamed over it once verified
+    partSuffix string = ".pcsync-part"
+)
+
+// PatchOptions configure Patch
+type PatchOptions struct {
+    Index        *Index
+    Repositories []Repository
+    // the region of this host. repositories tagged with it are preferred over the others of the same priority
+    Region       string
+    // the file to recreate. it's only replaced once the patched file matches the index
+    Output       string
+    // a local file believed to be similar to the reference (e.g. the previous image). it may be Output itself. with a
+    // bundle and no seed, the seed is Output when it exists
+    Seed         string
+    // the number of concurrent matchers of the seed file
+    Matchers     int
+    // discard any previous progress, and patch the part file from scratch
+    NoResume     bool
+    Progress     ProgressFunc
+    // called with every block range request made to a repository
+    OnSource     SourceFunc
+    // ranks the repositories, faster and healthier first, and is updated with the stats of this patch. may be nil
+    Mirrors      *MirrorScores
+    HTTP         HTTPOptions
+    // patch from the blocks of a bundle instead of the repositories, with no network. the index must be the bundle's
+    Bundle       *Bundle
+}
+
+// PatchResult accounts for where the bytes of the output came from
+type PatchResult struct {
+    FileSize    int64
+    // validated from a previous run
+    Resumed     int64
+    // copied from the seed file
+    SeedMatched int64
+    // fetched from the repositories
+    Fetched     int64
+    Duration    time.Duration
+    // the requests made to each repository
+    Sources     []SourceStats
+}
+
+// Patch recreates the reference file of the index at opts.Output. The reference is written to <output>.pcsync-part, and
+// only replaces the output once its root checksum matches the index, so a failed patch leaves the output untouched.
+// Progress is recorded in <output>.pcsync-state, so a cancelled or interrupted patch resumes with the blocks that are
+// still missing.
+func Patch(ctx context.Context, opts PatchOptions) (*PatchResult, error) {
+    var (
+        idx          = opts.Index
+        header       = idx.header
+        outFileName  = opts.Output
+        partFileName = partPath(outFileName)
+        outFile      *os.File = nil
+        err          error = nil
+        start        = time.Now()
+    )
+    if len(outFileName) == 0 {
+        return nil, errors.New("invalid output filename")
+    }
+    var (
+        requesters []blocksources.BlockSourceRequester = nil
+        sources    = RepositoryURLs(opts.Repositories)
+    )
+    if opts.Bundle != nil {
+        if opts.Bundle.index != idx {
+            return nil, errors.New("[ERR] the index is not the bundle's")
+        }
+        requesters, sources = []blocksources.BlockSourceRequester{&bundleRequester{bundle: opts.Bundle}}, []string{opts.Bundle.name}
+        // the repositories are not requested
+        opts.Repositories, opts.Mirrors = nil, nil
+        // the bundle is patched against the old file, which is usually the output being updated. without one, every block
+        // has to be in the bundle, which is checked once the bundle's blocks are known
+        if len(opts.Seed) == 0 {
+            if _, err := os.Stat(outFileName); !os.IsNotExist(err) {
+                opts.Seed = outFileName
+            }
+        }
+    } else if requesters, err = newRepositoryRequesters(opts.Repositories, opts.HTTP); err != nil {
+        return nil, err
+    }
+    // otuput is patched into a part file next to it. it's kept as is when resuming, and truncated when the previous progress
+    // is discarded
+    if opts.NoResume {
+        outFile, err = os.Create(partFileName)
+    } else {
+        outFile, err = os.OpenFile(partFileName, os.O_RDWR|os.O_CREATE, 0644)
+    }
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer outFile.Close()
+
+    var (
+        filesize, blocksize, blockcount, rootHash = header.FileSize, header.BlockSize, header.BlockCount, header.RootHash
+        tracker    = newSourceTracker(sources, opts.OnSource)
+        order, shares = repositoryPreference(opts.Repositories, opts.Region, opts.Mirrors)
+    )
+    // failed patches count too. a mirror serving bad data may be why it failed. peers come and go, and refuse the blocks
+    // they don't have yet, so they aren't recorded
+    if opts.Mirrors != nil {
+        defer func() {
+            var stats []SourceStats = nil
+            for _, s := range tracker.snapshot() {
+                if !opts.Repositories[s.SourceID].Peer {
+                    stats = append(stats, s)
+                }
+            }
+            opts.Mirrors.Update(stats)
+        }()
+    }
+
+    // every patch goes through the block fetcher, so the priorities, weights and regions of the repositories apply with
+    // or without a seed or previous progress
+    fetcher := &blockFetcher{
+        requesters: requesters,
+        lookup:     idx.lookup,
+        strongHash: header.StrongHash,
+        layout:     idx.layout,
+        tracker:    tracker,
+        order:      order,
+        shares:     shares,
+    }
+    journalHead := journalHeader(filesize, blocksize, blockcount, rootHash)
+    journal, result, err := patchSpans(ctx, opts, outFile, journalHead, fetcher)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    if err := commitOutput(outFile, outFileName, header); err != nil {
+        journal.Remove()
+        return nil, errors.WithStack(err)
+    }
+    result.Duration = time.Now().Sub(start)
+    result.Sources = tracker.snapshot()
+    return result, journal.Remove()
+}
+
+func partPath(outFileName string) string {
+    return outFileName + partSuffix
+}
+
+// commitOutput checks the part file against the index root checksum, syncs it, then atomically renames it over the
+// output. On mismatch the part file is removed and the output is left untouched.
+func commitOutput(partFile *os.File, outFileName string, header *Header) error {
+    var partFileName = partFile.Name()
+
+    if err := verifyRootChecksum(partFile, header); err != nil {
+        partFile.Close()
+        os.Remove(partFileName)
+        return errors.WithMessage(err, "patched file does not match the index. " + outFileName + " is left untouched")
+    }
+    if err := partFile.Sync(); err != nil {
+        return errors.WithStack(err)
+    }
+    if err := partFile.Close(); err != nil {
+        return errors.WithStack(err)
+    }
+    if err := os.Rename(partFileName, outFileName); err != nil {
+        return errors.WithStack(err)
+    }
+    // make the rename itself durable
+    if dir, err := os.Open(filepath.Dir(outFileName)); err == nil {
+        dir.Sync()
+        dir.Close()
+    }
+    log.Infof("%v verified and saved", outFileName)
+    return nil
+}
+
+// returns the index blocks present in a seed file. fixed size blocks are matched the same way diff does, and content
+// defined chunks by chunking the seed with the index parameters.
+func matchSeed(ctx context.Context, idx *Index, seedFile *os.File, seedSize int64, numMatchers int64) ([]patcher.FoundBlockSpan, error) {
+    header := idx.header
+    if idx.cdc != nil {
+        found, err := cdcMatch(&contextReader{ctx: ctx, Reader: seedFile}, idx.cdc, header.StrongHash)
+        if err != nil {
+            return nil, err
+        }
+        return cdcFoundSpans(idx.cdc, found), nil
+    }
+    merger, _, failed := multithreadedMatching(ctx, seedFile, idx.index, seedSize, numMatchers, uint(header.BlockSize), header.StrongHash, maxMatchSectionSize)
+    spans := merger.GetMergedBlocks()
+    if err := <-failed; err != nil {
+        return nil, err
+    }
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return toPatcherFoundSpan(spans, int64(header.BlockSize)), nil
+}
+
+// patchSpans writes the part file in place, block range by block range. Blocks validated from a previous run's journal are
+// kept, blocks found in the seed file are copied locally, and only the remaining spans are requested from the repositories.
+func patchSpans(
+    ctx          context.Context,
+    opts         PatchOptions,
+    outFile      *os.File,
+    journalHead  string,
+    fetcher      *blockFetcher,
+) (*patchJournal, *PatchResult, error) {
+    var (
+        outFileName = opts.Output
+        blockcount  = fetcher.layout.blockCount()
+        filesize    = fetcher.filesize()
+        done        []bool = make([]bool, blockcount)
+        found       []patcher.FoundBlockSpan = nil
+        missing     []patcher.MissingBlockSpan = nil
+        seedFile    *os.File = nil
+        // the blocks a bundle carries, nil without a bundle
+        bundled     []bool = nil
+        start       = time.Now()
+    )
+    if opts.Bundle != nil {
+        bundled = opts.Bundle.bundledBlocks()
+    }
+
+    // validate what a previous run has written
+    if !opts.NoResume {
+        ranges, err := readJournalRanges(journalPath(outFileName), journalHead)
+        if err != nil {
+            return nil, nil, errors.WithStack(err)
+        }
+        done, err = validateJournalRanges(outFile, ranges, fetcher.lookup, fetcher.strongHash.New(), fetcher.layout)
+        if err != nil {
+            return nil, nil, errors.WithStack(err)
+        }
+    }
+    if err := outFile.Truncate(filesize); err != nil {
+        return nil, nil, errors.WithStack(err)
+    }
+    journal, err := createJournal(journalPath(outFileName), journalHead, outFile, done)
+    if err != nil {
+        return nil, nil, errors.WithStack(err)
+    }
+
+    // match the seed file for what's not done yet
+    if len(opts.Seed) != 0 {
+        seedFile, err = os.Open(opts.Seed)
+        if err != nil {
+            journal.Close()
+            return nil, nil, errors.WithMessage(err, "unable to open seed file " + opts.Seed)
+        }
+        defer seedFile.Close()
+
+        fi, err := seedFile.Stat()
+        if err != nil {
+            journal.Close()
+            return nil, nil, errors.WithMessage(err, "Could not get info on seed file:")
+        }
+        // there's nothing to look for in the seed when the bundle carries every block left
+        if blockcount > 0 && !(bundled != nil && len(lackingBundleBlocks(bundled, done)) == 0) {
+            matched, err := matchSeed(ctx, opts.Index, seedFile, fi.Size(), int64(opts.Matchers))
+            if err != nil {
+                journal.Close()
+                return nil, nil, errors.WithMessage(err, "unable to match seed file")
+            }
+            // the blocks a bundle carries are taken from it, even where the seed has them as well
+            if bundled != nil {
+                matched = filterFoundSpans(matched, bundled, fetcher.layout)
+            }
+            found = filterFoundSpans(matched, done, fetcher.layout)
+        }
+        for _, s := range found {
+            for b := s.StartBlock; b <= s.EndBlock; b++ {
+                done[b] = true
+            }
+        }
+    }
+    // the span table of a bundle tells the blocks to find in the seed. failing now beats failing once the bundle is read
+    if bundled != nil {
+        if lacking := lackingBundleBlocks(bundled, done); len(lacking) != 0 {
+            journal.Close()
+            if len(opts.Seed) == 0 {
+                return nil, nil, errors.Errorf("[ERR] blocks %v are not in the bundle, and there is no seed file to take them from", strings.Join(lacking, ", "))
+            }
+            return nil, nil, errors.Errorf("[ERR] blocks %v are neither in the bundle nor in the seed file '%v'. the bundle was made against another file", strings.Join(lacking, ", "), opts.Seed)
+        }
+    }
+    missing = blockRanges(done, false)
+
+    var resumedBytes, foundBytes, missingBytes int64 = filesize, 0, 0
+    for _, s := range found {
+        b, e := fetcher.blockRangeOffsets(s.StartBlock, s.EndBlock)
+        foundBytes += e - b
+    }
+    for _, s := range missing {
+        b, e := fetcher.blockRangeOffsets(s.StartBlock, s.EndBlock)
+        missingBytes += e - b
+    }
+    resumedBytes -= foundBytes + missingBytes
+    result := &PatchResult{FileSize: filesize, Resumed: resumedBytes, SeedMatched: foundBytes, Fetched: missingBytes}
+    log.Infof("Resumed %v bytes | Seed matched %v bytes | %v bytes to fetch from repositories (%v)", resumedBytes, foundBytes, missingBytes, time.Now().Sub(start))
+
+    written := newProgressCounter(filesize, opts.Progress)
+    written(resumedBytes)
+    completed := func(startBlock, endBlock uint, n int64) {
+        written(n)
+        if err := journal.record(startBlock, endBlock); err != nil {
+            log.Warnf("unable to record progress : %v", err.Error())
+        }
+    }
+    if seedFile != nil {
+        var changed []uint = nil
+        if changed, err = fetcher.copyFoundSpans(ctx, outFile, seedFile, found, completed); err == nil && len(changed) != 0 {
+            log.Warnf("%v blocks of the seed file changed since it was matched. they're fetched instead", len(changed))
+            for _, b := range changed {
+                done[b] = false
+                start, end := fetcher.blockRangeOffsets(b, b)
+                result.SeedMatched -= end - start
+                result.Fetched += end - start
+            }
+            missing = blockRanges(done, false)
+        }
+    }
+    if err == nil {
+        err = fetcher.fetchSpansInto(ctx, outFile, missing, completed)
+    }
+    if err != nil {
+        journal.Close()
+        return nil, nil, errors.WithStack(err)
+    }
+
+    end := time.Now()
+    log.Infof("Time duration %v | Data Rate %v/sec", end.Sub(start).Seconds(), int64(float64(missingBytes) / end.Sub(start).Seconds()))
+    return journal, result, nil
+}
+
+// returns the block ranges that are neither done nor bundled, as "start-end"
+func lackingBundleBlocks(bundled []bool, done []bool) []string {
+    lacking := make([]bool, len(done))
+    for b := range done {
+        lacking[b] = !done[b] && !bundled[b]
+    }
+    var ranges []string = nil
+    for _, s := range blockRanges(lacking, true) {
+        ranges = append(ranges, fmt.Sprintf("%v-%v", s.StartBlock, s.EndBlock))
+    }
+    return ranges
+}
@@ -0,0 +1,179 @@
+package pcsync
+
+import (
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+)
+
+// Nodes patching the same index serve each other the blocks they already have, so the repositories are requested about
+// once per cluster rather than once per node. A peer only serves block ranges whose data matches the index strong
+// checksums at the time of the request, whatever state its file is in.
+
+const (
+    // the path of the blocks of an index is followed by its root hash, so peers only serve the index they're patching
+    peerPathPrefix string = "/pcsync/peer/"
+    // peers are tried before the repositories of the list
+    peerPriorityOffset = 1
+    // the largest range a peer reads and verifies for a request
+    maxPeerRequestSize int64 = 64 * mb
+    // the requests read and verified at once. the others wait for their turn, which bounds the memory held by the
+    // ranges being read to maxPeerConcurrentReads * maxPeerRequestSize
+    maxPeerConcurrentReads = 4
+)
+
+var peerRangePattern = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// PeerPath returns the url path of the blocks of an index on a peer
+func PeerPath(header *Header) string {
+    return peerPathPrefix + hex.EncodeToString(header.RootHash)
+}
+
+// PeerServer serves the verified blocks of the reference file of an index, as patched at output. Blocks are read from
+// the part file while the patch is in progress, and from output otherwise.
+type PeerServer struct {
+    idx    *Index
+    output string
+    slots  chan struct{}
+}
+
+// NewPeerServer returns the peer handler of the reference file patched at output. HealthPath answers 200.
+func NewPeerServer(idx *Index, output string) *PeerServer {
+    return &PeerServer{idx: idx, output: output, slots: make(chan struct{}, maxPeerConcurrentReads)}
+}
+
+// PeerRepositories returns the repositories of the peers at peerURLs (e.g. "http://node2:7070"), followed by repos.
+// peers come first, with a priority before any of repos.
+func PeerRepositories(peerURLs []string, header *Header, repos []Repository) []Repository {
+    priority := 0
+    for i, repo := range repos {
+        if i == 0 || repo.Priority < priority {
+            priority = repo.Priority
+        }
+    }
+    var peers []Repository = nil
+    for _, peer := range peerURLs {
+        peers = append(peers, Repository{URL: strings.TrimSuffix(peer, "/") + PeerPath(header), Priority: priority - peerPriorityOffset, Peer: true})
+    }
+    return append(peers, repos...)
+}
+
+func (p *PeerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    switch {
+    case r.URL.Path == HealthPath:
+        w.Header().Set("Cache-Control", "no-store")
+        io.WriteString(w, "ok\n")
+        return
+    case r.URL.Path != PeerPath(p.idx.header):
+        http.NotFound(w, r)
+        return
+    case r.Method != "GET" && r.Method != "HEAD":
+        w.Header().Set("Allow", "GET, HEAD")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var (
+        filesize   = p.idx.header.FileSize
+        start, end int64 = 0, filesize
+    )
+    if rangeHeader := r.Header.Get("Range"); len(rangeHeader) != 0 {
+        match := peerRangePattern.FindStringSubmatch(rangeHeader)
+        if match == nil {
+            p.unavailable(w, "only single byte ranges are served")
+            return
+        }
+        start, _ = strconv.ParseInt(match[1], 10, 64)
+        if len(match[2]) != 0 {
+            last, _ := strconv.ParseInt(match[2], 10, 64)
+            end = last + 1
+        }
+        if end > filesize {
+            end = filesize
+        }
+    }
+    if start >= end {
+        p.unavailable(w, "empty range")
+        return
+    }
+    if end - start > maxPeerRequestSize {
+        p.unavailable(w, fmt.Sprintf("ranges over %v bytes are not served", maxPeerRequestSize))
+        return
+    }
+    // a requester gone while waiting isn't read for
+    select {
+    case p.slots <- struct{}{}:
+    case <-r.Context().Done():
+        return
+    }
+    defer func() {
+        <-p.slots
+    }()
+    data, err := p.readVerified(start, end)
+    if err != nil {
+        log.Debugf("peer request of bytes %v-%v : %v", start, end - 1, err.Error())
+        p.unavailable(w, err.Error())
+        return
+    }
+    w.Header().Set("Accept-Ranges", "bytes")
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Content-Length", strconv.FormatInt(end - start, 10))
+    w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end - 1, filesize))
+    w.WriteHeader(http.StatusPartialContent)
+    if r.Method == "GET" {
+        w.Write(data)
+    }
+}
+
+// blocks the peer doesn't have, or can't vouch for, are refused with a client error so requesters move on to the
+// next repository without retrying
+func (p *PeerServer) unavailable(w http.ResponseWriter, reason string) {
+    w.Header().Set("Content-Range", fmt.Sprintf("bytes */%v", p.idx.header.FileSize))
+    http.Error(w, reason, http.StatusRequestedRangeNotSatisfiable)
+}
+
+// reads the blocks covering [start, end) from the part file, or from the output, and checks them against the index
+// return : the bytes [start, end)
+func (p *PeerServer) readVerified(start, end int64) ([]byte, error) {
+    var (
+        layout     = p.idx.layout
+        startBlock = blockAt(layout, start)
+        endBlock   = blockAt(layout, end - 1)
+        blockStart, blockEnd = blockRangeOffsets(layout, startBlock, endBlock)
+        data       = make([]byte, blockEnd - blockStart)
+        lastErr    error = errors.Errorf("blocks %v-%v are not available", startBlock, endBlock)
+    )
+    for _, name := range []string{partPath(p.output), p.output} {
+        f, err := os.Open(name)
+        if err != nil {
+            continue
+        }
+        n, _ := f.ReadAt(data, blockStart)
+        f.Close()
+        if int64(n) != blockEnd - blockStart {
+            continue
+        }
+        if bad := mismatchingBlocks(p.idx.header.StrongHash.New(), p.idx.lookup, layout, startBlock, data); len(bad) != 0 {
+            lastErr = errors.Errorf("blocks %v of %v are not verified", bad, name)
+            continue
+        }
+        return data[start - blockStart:end - blockStart], nil
+    }
+    return nil, lastErr
+}
+
+// returns the block holding the byte at offset
+func blockAt(layout blockLayout, offset int64) uint {
+    return uint(sort.Search(int(layout.blockCount()), func(b int) bool {
+        _, end := layout.blockOffsets(uint(b))
+        return end > offset
+    }))
+}
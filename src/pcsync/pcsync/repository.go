@@ -0,0 +1,453 @@
+package pcsync
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/blocksources"
+)
+
+// A repository list is either plain text, one source url per line, or JSON :
+//   {"repositories": [{"url": "https://...", "priority": 0, "weight": 2, "max_concurrency": 4, "timeout": "30s",
+//     "region": "us-west", "headers": {"Authorization": "Bearer ${MIRROR_TOKEN}"}}]}
+// a JSON array of repositories, or of urls, is read as well.
+
+const (
+    // the request timeout of repositories that don't set one
+    defaultRepositoryTimeout = time.Duration(10) * time.Second
+    // bounds the request shares a repository gets
+    maxRepositoryWeight      = 1000
+)
+
+var headerVariablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Repository is a source of the reference file
+type Repository struct {
+    URL            string            `json:"url"`
+    // repositories are tried by ascending priority. higher priorities are only fallbacks
+    Priority       int               `json:"priority,omitempty"`
+    // the share of the requests among the preferred repositories. 0 counts as 1
+    Weight         int               `json:"weight,omitempty"`
+    // the maximum number of requests in flight. 0 is unlimited
+    MaxConcurrency int               `json:"max_concurrency,omitempty"`
+    // the timeout of a request. 0 is the timeout of the http options
+    Timeout        Duration          `json:"timeout,omitempty"`
+    // repositories of the local region are preferred over the others of the same priority
+    Region         string            `json:"region,omitempty"`
+    // added to every request. values expand ${VAR} from the environment when requests are made, so tokens need not be
+    // written in the list
+    Headers        map[string]string `json:"headers,omitempty"`
+    // a node patching the same index (see PeerRepositories). peers aren't ranked by the mirror scores
+    Peer           bool              `json:"-"`
+}
+
+// Duration is a time.Duration written in JSON as a duration string ("30s"). plain numbers are read as seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var seconds float64
+    if err := json.Unmarshal(data, &seconds); err == nil {
+        *d = Duration(seconds * float64(time.Second))
+        return nil
+    }
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return errors.Errorf("invalid duration %v", string(data))
+    }
+    parsed, err := time.ParseDuration(s)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    *d = Duration(parsed)
+    return nil
+}
+
+// RepositoryList is the JSON repository list
+type RepositoryList struct {
+    Repositories []Repository `json:"repositories"`
+}
+
+// ReadRepositoryList reads and validates a repository list, in JSON or plain text
+func ReadRepositoryList(r io.Reader) ([]Repository, error) {
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    var repos []Repository = nil
+    trimmed := bytes.TrimLeft(data, " \t\r\n\ufeff")
+    if len(trimmed) != 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+        repos, err = parseJSONRepositoryList(trimmed)
+    } else {
+        repos, err = parseTextRepositoryList(data)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := ValidateRepositories(repos); err != nil {
+        return nil, err
+    }
+    return repos, nil
+}
+
+func parseJSONRepositoryList(data []byte) ([]Repository, error) {
+    var entries []json.RawMessage = nil
+    if data[0] == '{' {
+        var list struct {
+            Repositories []json.RawMessage `json:"repositories"`
+        }
+        if err := json.Unmarshal(data, &list); err != nil {
+            return nil, errors.WithMessage(err, "invalid repository list")
+        }
+        entries = list.Repositories
+    } else if err := json.Unmarshal(data, &entries); err != nil {
+        return nil, errors.WithMessage(err, "invalid repository list")
+    }
+    repos := make([]Repository, len(entries))
+    for i, entry := range entries {
+        // a bare url is a repository with the defaults
+        if err := json.Unmarshal(entry, &repos[i].URL); err == nil {
+            continue
+        }
+        if err := json.Unmarshal(entry, &repos[i]); err != nil {
+            return nil, errors.WithMessage(err, fmt.Sprintf("invalid repository %v", i))
+        }
+    }
+    return repos, nil
+}
+
+// one url per line. blank lines and lines starting with # are skipped
+func parseTextRepositoryList(data []byte) ([]Repository, error) {
+    var (
+        scanner *bufio.Scanner = bufio.NewScanner(bytes.NewReader(data))
+        repos   []Repository = nil
+    )
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if len(line) == 0 || strings.HasPrefix(line, "#") {
+            continue
+        }
+        repos = append(repos, Repository{URL: line})
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, errors.WithStack(err)
+    }
+    return repos, nil
+}
+
+// WriteRepositoryList writes a repository list in JSON. a list of bare urls is written as the JSON array of its urls,
+// as lists were before repositories had fields of their own, so the readers of that format keep reading it.
+func WriteRepositoryList(w io.Writer, repos []Repository) error {
+    urlsOnly := true
+    for _, repo := range repos {
+        urlsOnly = urlsOnly && repo.urlOnly()
+    }
+    if urlsOnly {
+        return errors.WithStack(json.NewEncoder(w).Encode(RepositoryURLs(repos)))
+    }
+    data, err := json.MarshalIndent(RepositoryList{Repositories: repos}, "", "  ")
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    _, err = w.Write(append(data, '\n'))
+    return errors.WithStack(err)
+}
+
+// no field but the url is set
+func (r Repository) urlOnly() bool {
+    return r.Priority == 0 && r.Weight == 0 && r.MaxConcurrency == 0 && r.Timeout == 0 && len(r.Region) == 0 && len(r.Headers) == 0
+}
+
+// ValidateRepositories checks the fields of every repository, and that no url is listed twice
+func ValidateRepositories(repos []Repository) error {
+    if len(repos) == 0 {
+        return errors.New("[ERR] the repository list is empty")
+    }
+    seen := map[string]int{}
+    for i, repo := range repos {
+        if err := repo.validate(); err != nil {
+            return errors.WithMessage(err, fmt.Sprintf("[ERR] invalid repository %v", i))
+        }
+        if previous, ok := seen[repo.URL]; ok {
+            return errors.Errorf("[ERR] repository %v is listed twice (%v and %v)", repo.URL, previous, i)
+        }
+        seen[repo.URL] = i
+    }
+    return nil
+}
+
+func (r *Repository) validate() error {
+    u, err := url.Parse(r.URL)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+        return errors.Errorf("%v is not an http or https url", r.URL)
+    }
+    if r.Weight < 0 || r.Weight > maxRepositoryWeight {
+        return errors.Errorf("weight %v of %v is out of 0-%v", r.Weight, r.URL, maxRepositoryWeight)
+    }
+    if r.MaxConcurrency < 0 {
+        return errors.Errorf("negative max_concurrency %v of %v", r.MaxConcurrency, r.URL)
+    }
+    if r.Timeout < 0 {
+        return errors.Errorf("negative timeout %v of %v", time.Duration(r.Timeout), r.URL)
+    }
+    for name, value := range r.Headers {
+        if !validHeaderName(name) {
+            return errors.Errorf("invalid header name %q of %v", name, r.URL)
+        }
+        // the range of every request is ours to set
+        if http.CanonicalHeaderKey(name) == "Range" {
+            return errors.Errorf("the Range header of %v can't be set", r.URL)
+        }
+        if strings.ContainsAny(value, "\r\n\x00") {
+            return errors.Errorf("invalid value of header %v of %v", name, r.URL)
+        }
+    }
+    return nil
+}
+
+// header names are RFC 7230 tokens
+func validHeaderName(name string) bool {
+    if len(name) == 0 {
+        return false
+    }
+    for _, c := range name {
+        if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+            return false
+        }
+    }
+    return true
+}
+
+// RepositoryURLs returns the url of every repository
+func RepositoryURLs(repos []Repository) []string {
+    urls := make([]string, len(repos))
+    for i, repo := range repos {
+        urls[i] = repo.URL
+    }
+    return urls
+}
+
+// returns a block requester for each repository, configured by the http options. the index of a requester is its
+// repository id
+func newRepositoryRequesters(repos []Repository, opts HTTPOptions) ([]blocksources.BlockSourceRequester, error) {
+    // the repositories share the connections
+    transport, err := opts.NewTransport()
+    if err != nil {
+        return nil, err
+    }
+    var (
+        requesters []blocksources.BlockSourceRequester = nil
+        backoff    = time.Duration(opts.Backoff)
+    )
+    if backoff <= 0 {
+        backoff = defaultRetryBackoff
+    }
+    for rID, repo := range repos {
+        // headers are left out, they're likely credentials
+        log.Infof("%v : %v", rID, repo.URL)
+        timeout := time.Duration(repo.Timeout)
+        if timeout == 0 {
+            timeout = time.Duration(opts.Timeout)
+        }
+        if timeout == 0 {
+            timeout = defaultRepositoryTimeout
+        }
+        var requester blocksources.BlockSourceRequester = &httpRequester{
+            url:       repo.URL,
+            userAgent: opts.UserAgentString(),
+            headers:   repo.Headers,
+            client:    &http.Client{Transport: transport, Timeout: timeout},
+        }
+        // a retry waiting for its backoff gives its slot up
+        if repo.MaxConcurrency > 0 {
+            requester = &limitedRequester{BlockSourceRequester: requester, slots: make(chan struct{}, repo.MaxConcurrency)}
+        }
+        if opts.Retries > 0 {
+            requester = &retryingRequester{BlockSourceRequester: requester, retries: opts.Retries, backoff: backoff}
+        }
+        requesters = append(requesters, requester)
+    }
+    return requesters, nil
+}
+
+// returns the repository ids in the order they're tried, and the ids sharing the requests, each repeated by its weight.
+// repositories are ordered by priority, then the ones of the local region first, then by mirror score. the requests are
+// shared by the first of these groups, among the repositories scoring at least mirrorPreferredRatio of its best score.
+func repositoryPreference(repos []Repository, region string, mirrors *MirrorScores) ([]int, []int) {
+    var (
+        order  = make([]int, len(repos))
+        scores = mirrors.scores(RepositoryURLs(repos))
+        score  = func(id int) float64 {
+            if scores == nil {
+                return 0
+            }
+            return scores[id]
+        }
+        remote = func(id int) bool {
+            return len(region) == 0 || repos[id].Region != region
+        }
+    )
+    for i := range order {
+        order[i] = i
+    }
+    if len(repos) == 0 {
+        return order, nil
+    }
+    sort.SliceStable(order, func(a, b int) bool {
+        ra, rb := order[a], order[b]
+        if repos[ra].Priority != repos[rb].Priority {
+            return repos[ra].Priority < repos[rb].Priority
+        }
+        if remote(ra) != remote(rb) {
+            return !remote(ra)
+        }
+        return score(ra) > score(rb)
+    })
+
+    var (
+        first  = order[0]
+        best   = score(first)
+        shares []int = nil
+    )
+    for _, id := range order {
+        if repos[id].Priority != repos[first].Priority || remote(id) != remote(first) {
+            break
+        }
+        if score(id) < best * mirrorPreferredRatio {
+            continue
+        }
+        weight := repos[id].Weight
+        if weight == 0 {
+            weight = 1
+        }
+        for w := 0; w < weight; w++ {
+            shares = append(shares, id)
+        }
+    }
+    return order, shares
+}
+
+// httpRequester requests byte ranges of a repository over http, with the repository's headers
+type httpRequester struct {
+    url       string
+    userAgent string
+    headers   map[string]string
+    client    *http.Client
+}
+
+// httpStatusError is a request answered with an unexpected status
+type httpStatusError struct {
+    url    string
+    status string
+    code   int
+}
+
+func (e *httpStatusError) Error() string {
+    return fmt.Sprintf("%v : %v", e.url, e.status)
+}
+
+// requests the byte range [start, end)
+func (r *httpRequester) DoRequest(start, end int64) ([]byte, error) {
+    if end <= start {
+        return nil, nil
+    }
+    req, err := http.NewRequest("GET", r.url, nil)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    req.Header.Set("User-Agent", r.userAgent)
+    for name, value := range r.headers {
+        expanded, err := expandHeader(value)
+        if err != nil {
+            return nil, errors.WithMessage(err, "header " + name)
+        }
+        req.Header.Set(name, expanded)
+    }
+    req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", start, end - 1))
+
+    resp, err := r.client.Do(req)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer resp.Body.Close()
+    // a server ignoring the range sends the whole file, which is only of use for a range at its start
+    if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && start == 0) {
+        return nil, &httpStatusError{url: r.url, status: resp.Status, code: resp.StatusCode}
+    }
+    data, err := ioutil.ReadAll(io.LimitReader(resp.Body, end - start))
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    return data, nil
+}
+
+// replaces ${NAME} with the environment variable NAME. anything else, $NAME included, is kept as is, since header values
+// may hold dollar signs of their own
+func expandHeader(value string) (string, error) {
+    var unset []string = nil
+    expanded := headerVariablePattern.ReplaceAllStringFunc(value, func(variable string) string {
+        name := headerVariablePattern.FindStringSubmatch(variable)[1]
+        v, ok := os.LookupEnv(name)
+        if !ok {
+            unset = append(unset, name)
+        }
+        return v
+    })
+    if len(unset) != 0 {
+        return "", errors.Errorf("unset environment variables : %v", strings.Join(unset, ", "))
+    }
+    return expanded, nil
+}
+
+func (r *httpRequester) IsFatal(err error) bool {
+    return isFatalHTTPError(err)
+}
+
+// client errors other than timeouts and throttling won't get better by retrying. a server that doesn't do ranges won't either
+func isFatalHTTPError(err error) bool {
+    statusErr, ok := errors.Cause(err).(*httpStatusError)
+    if !ok {
+        return false
+    }
+    switch {
+    case statusErr.code == http.StatusOK:
+        return true
+    case statusErr.code == http.StatusRequestTimeout || statusErr.code == http.StatusTooManyRequests:
+        return false
+    default:
+        return statusErr.code >= 400 && statusErr.code < 500
+    }
+}
+
+// limitedRequester bounds the requests in flight to a repository
+type limitedRequester struct {
+    blocksources.BlockSourceRequester
+    slots chan struct{}
+}
+
+func (r *limitedRequester) DoRequest(start, end int64) ([]byte, error) {
+    r.slots <- struct{}{}
+    defer func() {
+        <-r.slots
+    }()
+    return r.BlockSourceRequester.DoRequest(start, end)
+}
@@ -0,0 +1,142 @@
+package pcsync
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // answers 200 as long as the server runs
+    HealthPath string = "/healthz"
+)
+
+// NewFileServer returns a handler serving the files under root, such as images and their indexes, for repositories.
+// GET and HEAD are answered with Range, If-Range and ETag support, so patches can request block ranges.
+// Directories aren't listed. Hidden files, and the part and state files of a patch in progress, aren't served.
+// Every request is written to accessLog, in the combined log format, when it's not nil.
+func NewFileServer(root string, accessLog io.Writer) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc(HealthPath, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-store")
+        io.WriteString(w, "ok\n")
+    })
+    mux.Handle("/", &fileServer{root: root})
+    if accessLog == nil {
+        return mux
+    }
+    return &accessLogger{handler: mux, out: accessLog}
+}
+
+type fileServer struct {
+    root string
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        w.Header().Set("Allow", "GET, HEAD")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    name := path.Clean("/" + r.URL.Path)
+    for _, element := range strings.Split(name, "/") {
+        if strings.HasPrefix(element, ".") || strings.HasSuffix(element, partSuffix) || strings.HasSuffix(element, journalSuffix) {
+            http.NotFound(w, r)
+            return
+        }
+    }
+    f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(name)))
+    if err != nil {
+        if os.IsPermission(err) {
+            http.Error(w, "forbidden", http.StatusForbidden)
+        } else {
+            http.NotFound(w, r)
+        }
+        return
+    }
+    defer f.Close()
+    stat, err := f.Stat()
+    if err != nil || !stat.Mode().IsRegular() {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("ETag", fileETag(stat))
+    w.Header().Set("Accept-Ranges", "bytes")
+    // ServeContent answers ranges, HEAD and the conditional requests against the ETag and modification time
+    http.ServeContent(w, r, name, stat.ModTime(), f)
+}
+
+// the size and modification time identify the content of a file for range requests, the same way common web servers do.
+// an image replaced in place gets a new tag, so If-Range requests don't mix two versions.
+func fileETag(stat os.FileInfo) string {
+    return fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size())
+}
+
+// accessLogger writes a line in the combined log format for every request
+type accessLogger struct {
+    handler http.Handler
+    lock    sync.Mutex
+    out     io.Writer
+}
+
+// statusRecorder keeps the status and size of a response
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    size   int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+    r.status = status
+    r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+    if r.status == 0 {
+        r.status = http.StatusOK
+    }
+    n, err := r.ResponseWriter.Write(p)
+    r.size += int64(n)
+    return n, err
+}
+
+func (l *accessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var (
+        start    = time.Now()
+        recorder = &statusRecorder{ResponseWriter: w}
+    )
+    l.handler.ServeHTTP(recorder, r)
+    if recorder.status == 0 {
+        recorder.status = http.StatusOK
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    logField := func(value string) string {
+        if len(value) == 0 {
+            return "-"
+        }
+        return value
+    }
+    line := fmt.Sprintf("%v - - [%v] %q %v %v %q %q %.3f\n",
+        host,
+        start.Format("02/Jan/2006:15:04:05 -0700"),
+        fmt.Sprintf("%v %v %v", r.Method, r.URL.RequestURI(), r.Proto),
+        recorder.status,
+        recorder.size,
+        logField(r.Referer()),
+        logField(r.UserAgent()),
+        time.Now().Sub(start).Seconds())
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    io.WriteString(l.out, line)
+}
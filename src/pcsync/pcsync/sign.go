@@ -0,0 +1,51 @@
+package pcsync
+
+import (
+    "bytes"
+
+    "github.com/pkg/errors"
+    "golang.org/x/crypto/ed25519"
+)
+
+// An index is signed with a detached Ed25519 signature. The signature covers the header fields and the root hash, and the
+// root hash covers every block checksum, so a signed header authenticates the whole index and the patched file.
+
+const (
+    // prefixed to the signed header, so an index signature can't be taken for anything else signed with the same key
+    indexSignatureContext string = "pcsync index signature v1\x00"
+)
+
+// SignIndex returns the signature of an index header
+func SignIndex(header *Header, key ed25519.PrivateKey) ([]byte, error) {
+    message, err := indexSignatureMessage(header)
+    if err != nil {
+        return nil, err
+    }
+    return ed25519.Sign(key, message), nil
+}
+
+// VerifyIndexSignature checks the signature of an index header against the trusted keys
+// return : the key that made the signature
+func VerifyIndexSignature(header *Header, signature []byte, trustedKeys []ed25519.PublicKey) (ed25519.PublicKey, error) {
+    message, err := indexSignatureMessage(header)
+    if err != nil {
+        return nil, err
+    }
+    for _, key := range trustedKeys {
+        if ed25519.Verify(key, message, signature) {
+            return key, nil
+        }
+    }
+    return nil, errors.New("[ERR] the index is not signed by a trusted key")
+}
+
+// the signed message : the context, then the header as written by writeHeader, with the version it was read with and
+// without the header checksum field
+func indexSignatureMessage(header *Header) ([]byte, error) {
+    buf := new(bytes.Buffer)
+    buf.WriteString(indexSignatureContext)
+    if err := writeHeaderFields(buf, header, header.Major, header.Minor, header.Patch, headerOptionalFields(header)); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
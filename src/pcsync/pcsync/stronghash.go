@@ -0,0 +1,76 @@
+package pcsync
+
+import (
+    "crypto/sha256"
+    "hash"
+    "sort"
+    "strings"
+
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/filechecksum"
+    "golang.org/x/crypto/blake2b"
+)
+
+// StrongHash identifies the strong block checksum algorithm of an index. It's recorded in the header from v0.3.
+type StrongHash uint16
+
+const (
+    // MD5 is the library default, and the only algorithm of v0.2 indexes
+    StrongHashMD5     StrongHash = 0
+    StrongHashSHA256  StrongHash = 1
+    StrongHashBLAKE2b StrongHash = 2
+
+    DefaultStrongHash StrongHash = StrongHashSHA256
+)
+
+var strongHashNames = map[StrongHash]string{
+    StrongHashMD5:     "md5",
+    StrongHashSHA256:  "sha256",
+    StrongHashBLAKE2b: "blake2b",
+}
+
+func (t StrongHash) String() string {
+    if name, ok := strongHashNames[t]; ok {
+        return name
+    }
+    return "unknown"
+}
+
+// New returns a new hash for the algorithm
+func (t StrongHash) New() hash.Hash {
+    switch t {
+    case StrongHashSHA256:
+        return sha256.New()
+    case StrongHashBLAKE2b:
+        // blake2b only fails with an oversized key
+        h, _ := blake2b.New256(nil)
+        return h
+    default:
+        return filechecksum.DefaultStrongHashGenerator()
+    }
+}
+
+func (t StrongHash) IsValid() bool {
+    _, ok := strongHashNames[t]
+    return ok
+}
+
+// ParseStrongHash returns the algorithm by its name (md5, sha256 or blake2b)
+func ParseStrongHash(name string) (StrongHash, error) {
+    var names []string = nil
+    for t, n := range strongHashNames {
+        if n == strings.ToLower(name) {
+            return t, nil
+        }
+        names = append(names, n)
+    }
+    sort.Strings(names)
+    return 0, errors.Errorf("unknown strong hash '%v'. use one of %v", name, strings.Join(names, ", "))
+}
+
+// returns a checksum generator that uses the strong hash algorithm instead of the library default
+func newChecksumGenerator(blocksize uint, strongHash StrongHash) *filechecksum.FileChecksumGenerator {
+    generator := filechecksum.NewFileChecksumGenerator(blocksize)
+    generator.StrongHash = strongHash.New()
+    return generator
+}
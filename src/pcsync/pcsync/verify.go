@@ -0,0 +1,264 @@
+package pcsync
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "io"
+    "io/ioutil"
+    "os"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/Redundancy/go-sync/chunks"
+)
+
+const (
+    // the number of block checksums generated per result
+    verifyBlocksPerResult = 64
+)
+
+// BlockRange is a range of consecutive index blocks, and the bytes they span in the reference file
+type BlockRange struct {
+    StartBlock uint
+    EndBlock   uint
+    Start      int64
+    End        int64
+}
+
+// VerifyResult holds the blocks of a local file that differ from the index at the same offsets
+type VerifyResult struct {
+    Mismatching       []BlockRange
+    MismatchingBlocks int
+    RootHashMatch     bool
+}
+
+// Verify compares a local file with the index, block by block (or chunk by chunk) at the index offsets. Unlike Diff,
+// blocks are not searched for elsewhere in the file, so corrupted blocks are reported. Blocks missing from the local file
+// are mismatching as well.
+func Verify(ctx context.Context, local io.Reader, idx *Index) (*VerifyResult, error) {
+    bad, localRootHash, err := blockMismatches(&contextReader{ctx: ctx, Reader: local}, idx)
+    if err != nil {
+        return nil, err
+    }
+    return verifyResult(idx, bad, localRootHash), nil
+}
+
+func verifyResult(idx *Index, bad []bool, localRootHash []byte) *VerifyResult {
+    result := &VerifyResult{RootHashMatch: bytes.Compare(localRootHash, idx.header.RootHash) == 0}
+    for _, r := range blockRanges(bad, true) {
+        start, end := blockRangeOffsets(idx.layout, r.StartBlock, r.EndBlock)
+        result.Mismatching = append(result.Mismatching, BlockRange{StartBlock: r.StartBlock, EndBlock: r.EndBlock, Start: start, End: end})
+        result.MismatchingBlocks += int(r.EndBlock - r.StartBlock + 1)
+    }
+    return result
+}
+
+// RepairOptions configure Repair
+type RepairOptions struct {
+    Index        *Index
+    Repositories []Repository
+    // the region of this host. repositories tagged with it are preferred over the others of the same priority
+    Region       string
+    // the local file to repair in place
+    File         string
+    Progress     ProgressFunc
+    // called with every block range request made to a repository
+    OnSource     SourceFunc
+    HTTP         HTTPOptions
+}
+
+// Repair repairs a local file in place. Blocks whose strong checksum does not match the index at the same offset are
+// fetched from the repositories and written back, then the file is checked against the index root checksum.
+// return : the blocks that were mismatching before the repair
+func Repair(ctx context.Context, opts RepairOptions) (*VerifyResult, error) {
+    var idx = opts.Index
+
+    localFile, err := os.OpenFile(opts.File, os.O_RDWR, 0)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer localFile.Close()
+    requesters, err := newRepositoryRequesters(opts.Repositories, opts.HTTP)
+    if err != nil {
+        return nil, err
+    }
+
+    bad, localRootHash, err := blockMismatches(&contextReader{ctx: ctx, Reader: localFile}, idx)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    result := verifyResult(idx, bad, localRootHash)
+    // trailing data is dropped, and missing blocks are fetched
+    if err := localFile.Truncate(idx.header.FileSize); err != nil {
+        return nil, errors.WithStack(err)
+    }
+
+    var (
+        order, shares = repositoryPreference(opts.Repositories, opts.Region, nil)
+        fetcher = &blockFetcher{
+            requesters: requesters,
+            lookup:     idx.lookup,
+            strongHash: idx.header.StrongHash,
+            layout:     idx.layout,
+            tracker:    newSourceTracker(RepositoryURLs(opts.Repositories), opts.OnSource),
+            order:      order,
+            shares:     shares,
+        }
+        missing      = blockRanges(bad, true)
+        missingBytes int64 = 0
+    )
+    for _, r := range result.Mismatching {
+        missingBytes += r.End - r.Start
+        log.Infof("mismatching blocks %v-%v (bytes %v-%v)", r.StartBlock, r.EndBlock, r.Start, r.End - 1)
+    }
+    log.Infof("%v bytes in %v ranges to repair", missingBytes, len(missing))
+
+    if len(missing) != 0 {
+        written := newProgressCounter(missingBytes, opts.Progress)
+        err = fetcher.fetchSpansInto(ctx, localFile, missing, func(_, _ uint, n int64) {
+            written(n)
+        })
+        if err != nil {
+            return nil, errors.WithStack(err)
+        }
+    }
+    if err := verifyRootChecksum(localFile, idx.header); err != nil {
+        return nil, errors.WithMessage(err, opts.File + " still does not match the index")
+    }
+    if err := localFile.Sync(); err != nil {
+        return nil, errors.WithStack(err)
+    }
+    return result, nil
+}
+
+// compares the local file with the index, block by block (or chunk by chunk) at the index offsets.
+// return : mismatching state of every index block, and the root checksum of the local file
+func blockMismatches(local io.Reader, idx *Index) ([]bool, []byte, error) {
+    if idx.cdc != nil {
+        return cdcChunkMismatches(local, idx.cdc, idx.header.StrongHash)
+    }
+    bad, localChecksums, err := alignedBlockMismatches(local, idx)
+    if err != nil {
+        return nil, nil, err
+    }
+    localRootHash, err := localChecksums.RootHash()
+    if err != nil {
+        return nil, nil, errors.WithStack(err)
+    }
+    return bad, localRootHash, nil
+}
+
+// hashes the local file block by block, and compares each block with the strong checksum of the same block in the index.
+// return : mismatching state of every index block, and the checksums of the local file
+func alignedBlockMismatches(local io.Reader, idx *Index) ([]bool, chunks.SequentialChecksumList, error) {
+    var (
+        header    = idx.header
+        generator = newChecksumGenerator(uint(header.BlockSize), header.StrongHash)
+        bad       = make([]bool, header.BlockCount)
+        checksums chunks.SequentialChecksumList = nil
+        results   = generator.StartChecksumGeneration(bufio.NewReaderSize(local, mb), verifyBlocksPerResult, header.StrongHash.New())
+    )
+    for i := range bad {
+        bad[i] = true
+    }
+    for result := range results {
+        if result.Err != nil {
+            return nil, nil, errors.WithStack(result.Err)
+        }
+        for _, chunk := range result.Checksums {
+            checksums = append(checksums, chunk)
+            if chunk.ChunkOffset >= uint(header.BlockCount) {
+                continue
+            }
+            bad[chunk.ChunkOffset] = bytes.Compare(chunk.StrongChecksum, idx.lookup.GetStrongChecksumForBlock(int(chunk.ChunkOffset))) != 0
+        }
+    }
+    return bad, checksums, nil
+}
+
+// reads the local file chunk by chunk at the offsets of a content defined index, and compares each chunk with its strong
+// checksum. chunks missing from the local file are mismatching as well.
+// return : mismatching state of every index chunk, and the root checksum of the local chunks read
+func cdcChunkMismatches(local io.Reader, idx *cdcIndex, strongHash StrongHash) ([]bool, []byte, error) {
+    var (
+        reader    = bufio.NewReaderSize(local, mb)
+        hasher    = strongHash.New()
+        bad       = make([]bool, len(idx.chunks))
+        chunkList []cdcChunk = nil
+        buf       = make([]byte, idx.params.Max)
+    )
+    for i, c := range idx.chunks {
+        n, err := io.ReadFull(reader, buf[:c.length])
+        if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+            return nil, nil, errors.WithStack(err)
+        }
+        hasher.Reset()
+        hasher.Write(buf[:n])
+        sum := hasher.Sum(nil)
+        bad[i] = uint32(n) != c.length || bytes.Compare(sum, c.strong) != 0
+        if n != 0 {
+            chunkList = append(chunkList, cdcChunk{offset: c.offset, length: uint32(n), strong: sum})
+        }
+    }
+    localRootHash, err := cdcRootHash(chunkList)
+    if err != nil {
+        return nil, nil, errors.WithStack(err)
+    }
+    return bad, localRootHash, nil
+}
+
+// recomputes the root checksum of a file the same way build does, and checks it against the index's
+func verifyRootChecksum(f *os.File, header *Header) error {
+    stat, err := f.Stat()
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if stat.Size() != header.FileSize {
+        return errors.Errorf("[ERR] mismatching file size %v, expected %v", stat.Size(), header.FileSize)
+    }
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return errors.WithStack(err)
+    }
+    if header.Chunking != nil {
+        return verifyCDCRootChecksum(f, header)
+    }
+    generator := newChecksumGenerator(uint(header.BlockSize), header.StrongHash)
+    cRootHash, _, err := generator.BuildSequentialAndRootChecksum(bufio.NewReaderSize(f, mb), ioutil.Discard)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if bytes.Compare(cRootHash, header.RootHash) != 0 {
+        return errors.Errorf("[ERR] mismatching integrity checksum")
+    }
+    return nil
+}
+
+// the root checksum of a content defined index is over the strong checksums of the chunks at the index offsets
+func verifyCDCRootChecksum(f *os.File, header *Header) error {
+    var (
+        hasher    = header.StrongHash.New()
+        chunker   = newCDCChunker(bufio.NewReaderSize(f, mb), *header.Chunking)
+        chunkList []cdcChunk = nil
+    )
+    // an identical file chunks at the same boundaries as the index
+    for {
+        data, offset, err := chunker.next()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return err
+        }
+        hasher.Reset()
+        hasher.Write(data)
+        chunkList = append(chunkList, cdcChunk{offset: offset, length: uint32(len(data)), strong: hasher.Sum(nil)})
+    }
+    cRootHash, err := cdcRootHash(chunkList)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if bytes.Compare(cRootHash, header.RootHash) != 0 {
+        return errors.Errorf("[ERR] mismatching integrity checksum")
+    }
+    return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "net/http"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/urfave/cli"
+    "pcsync/pcsync"
+)
+
+const (
+    peerUsage string = "pcsync peer <reference index> <local file>"
+)
+
+// the peer flags of patch
+var peerFlags = []cli.Flag{
+    cli.StringSliceFlag{
+        Name:  "peer",
+        Usage: "the url of a node serving its blocks of the same index (e.g. http://node2:7070), tried before the repositories. repeatable",
+    },
+    cli.StringFlag{
+        Name:  "peer-listen",
+        Usage: "serve the verified blocks of the output to the other nodes on this address (e.g. :7070) while patching",
+    },
+    cli.DurationFlag{
+        Name:  "peer-linger",
+        Usage: "with --peer-listen, keep serving for this long once the patch is done",
+    },
+}
+
+func init() {
+    app.Commands = append(
+        app.Commands,
+        cli.Command{
+            Name:      "peer",
+            Usage:     peerUsage,
+            Description: `Serve the blocks of a local file to the nodes patching the same index, until stopped.
+Only the blocks matching the index strong checksums at the time of a request are served. Other nodes use this node with
+"pcsync patch --peer http://<this node>:<port>", before the repositories of their list.
+<reference index> may be a local, unc network path or http/https url.`,
+            Action: Peer,
+            Flags: append([]cli.Flag{
+                cli.StringFlag{
+                    Name:  "listen",
+                    Value: ":7070",
+                    Usage: "the address to listen on",
+                },
+            }, append(signatureFlags, httpFlags...)...),
+        },
+    )
+}
+
+func Peer(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 2 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", peerUsage)
+    }
+    var (
+        indexName     = c.Args()[0]
+        localFileName = c.Args()[1]
+    )
+    idx, err := loadIndex(c, indexName)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    server := newPeerServer(c.String("listen"), idx, localFileName)
+    log.Infof("serving the blocks of %v on %v%v", localFileName, server.Addr, pcsync.PeerPath(idx.Header()))
+    return errors.WithStack(server.ListenAndServe())
+}
+
+func newPeerServer(listen string, idx *pcsync.Index, output string) *http.Server {
+    return &http.Server{
+        Addr:              listen,
+        Handler:           pcsync.NewPeerServer(idx, output),
+        ReadHeaderTimeout: time.Duration(10) * time.Second,
+        IdleTimeout:       time.Duration(120) * time.Second,
+    }
+}
+
+// serves the verified blocks of output while patching, when the command has --peer-listen
+// return : a function to call once the patch is done, which lingers for --peer-linger when it succeeded
+func startPatchPeer(c *cli.Context, idx *pcsync.Index, output string) func(patched bool) {
+    listen := c.String("peer-listen")
+    if len(listen) == 0 {
+        return func(bool) {}
+    }
+    server := newPeerServer(listen, idx, output)
+    go func() {
+        log.Infof("serving verified blocks to peers on %v%v", listen, pcsync.PeerPath(idx.Header()))
+        if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+            // the patch goes on without serving
+            log.Warnf("unable to serve peers : %v", err.Error())
+        }
+    }()
+    return func(patched bool) {
+        if linger := c.Duration("peer-linger"); patched && linger > 0 {
+            log.Infof("serving peers for %v", linger)
+            time.Sleep(linger)
+        }
+        server.Close()
+    }
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "sync"
+    "time"
+
+    "pcsync/pcsync"
+)
+
+// With --progress=json, commands write newline delimited JSON events to stdout, and nothing else. Logs go to stderr.
+
+const (
+    progressText string = "text"
+    progressJSON string = "json"
+)
+
+// jsonEvents writes one JSON object per line. events may be emitted from several goroutines.
+type jsonEvents struct {
+    lock    sync.Mutex
+    encoder *json.Encoder
+}
+
+func newJSONEvents(w io.Writer) *jsonEvents {
+    return &jsonEvents{encoder: json.NewEncoder(w)}
+}
+
+type startEvent struct {
+    Event      string   `json:"event"`
+    Time       string   `json:"time"`
+    Index      string   `json:"index"`
+    Output     string   `json:"output"`
+    Seed       string   `json:"seed,omitempty"`
+    Filesize   int64    `json:"filesize"`
+    Blockcount uint32   `json:"blockcount"`
+    Sources    []string `json:"sources"`
+}
+
+type progressEvent struct {
+    Event    string  `json:"event"`
+    Received int64   `json:"received"`
+    Total    int64   `json:"total"`
+    Percent  float64 `json:"percent"`
+    // bytes per second
+    Speed    float64 `json:"speed"`
+}
+
+type sourceEvent struct {
+    Event      string `json:"event"`
+    SourceID   int    `json:"source_id"`
+    Source     string `json:"source"`
+    Start      int64  `json:"start"`
+    End        int64  `json:"end"`
+    Bytes      int64  `json:"bytes"`
+    DurationMs int64  `json:"duration_ms"`
+    Error      string `json:"error,omitempty"`
+    Corrupted  bool   `json:"corrupted,omitempty"`
+}
+
+type errorEvent struct {
+    Event string `json:"event"`
+    Error string `json:"error"`
+}
+
+type summaryEvent struct {
+    Event       string        `json:"event"`
+    Success     bool          `json:"success"`
+    Filesize    int64         `json:"filesize"`
+    Resumed     int64         `json:"resumed"`
+    SeedMatched int64         `json:"seed_matched"`
+    Fetched     int64         `json:"fetched"`
+    DurationMs  int64         `json:"duration_ms"`
+    Sources     []sourceStats `json:"sources"`
+}
+
+type sourceStats struct {
+    SourceID         int    `json:"source_id"`
+    Source           string `json:"source"`
+    Bytes            int64  `json:"bytes"`
+    Requests         int    `json:"requests"`
+    Blocks           int64  `json:"blocks"`
+    Failures         int    `json:"failures"`
+    VerifyFailures   int    `json:"verify_failures"`
+    AverageLatencyMs int64  `json:"average_latency_ms"`
+}
+
+func (j *jsonEvents) emit(event interface{}) {
+    j.lock.Lock()
+    defer j.lock.Unlock()
+    // stdout going away leaves nobody to tell
+    j.encoder.Encode(event)
+}
+
+func (j *jsonEvents) start(event startEvent) {
+    event.Event = "start"
+    event.Time = time.Now().UTC().Format(time.RFC3339)
+    j.emit(event)
+}
+
+// returns a progress function emitting a progress event every second, and a function to stop
+func (j *jsonEvents) startProgress() (pcsync.ProgressFunc, func()) {
+    return startProgressTicker(func(written, total int64, percent, speed float64) {
+        j.emit(progressEvent{Event: "progress", Received: written, Total: total, Percent: percent, Speed: speed})
+    })
+}
+
+func (j *jsonEvents) source(e pcsync.SourceEvent) {
+    event := sourceEvent{
+        Event:      "source",
+        SourceID:   e.SourceID,
+        Source:     e.Source,
+        Start:      e.Start,
+        End:        e.End,
+        Bytes:      e.Bytes,
+        DurationMs: int64(e.Duration / time.Millisecond),
+        Corrupted:  e.Corrupted,
+    }
+    if e.Err != nil {
+        event.Error = e.Err.Error()
+    }
+    j.emit(event)
+}
+
+func (j *jsonEvents) error(err error) {
+    j.emit(errorEvent{Event: "error", Error: err.Error()})
+}
+
+// emits the final summary. result may be nil when the command failed
+func (j *jsonEvents) summary(result *pcsync.PatchResult, err error, duration time.Duration) {
+    event := summaryEvent{Event: "summary", Success: err == nil, DurationMs: int64(duration / time.Millisecond)}
+    if result != nil {
+        event.Filesize = result.FileSize
+        event.Resumed = result.Resumed
+        event.SeedMatched = result.SeedMatched
+        event.Fetched = result.Fetched
+        for _, s := range result.Sources {
+            event.Sources = append(event.Sources, sourceStats{
+                SourceID:         s.SourceID,
+                Source:           s.Source,
+                Bytes:            s.Bytes,
+                Requests:         s.Requests,
+                Blocks:           s.Blocks,
+                Failures:         s.Failures,
+                VerifyFailures:   s.VerifyFailures,
+                AverageLatencyMs: int64(s.AverageLatency() / time.Millisecond),
+            })
+        }
+    }
+    j.emit(event)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "context"
+    "os"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/urfave/cli"
+    "pcsync/pcsync"
+)
+
+const (
+    repairUsage string = "gosync repair <reference index> <reference repository list> <local file>"
+)
+
+func init() {
+    app.Commands = append(
+        app.Commands,
+        cli.Command{
+            Name:      "repair",
+            ShortName: "r",
+            Usage:     repairUsage,
+            Description: `Repair a local file in place. Blocks whose strong checksum does not match the index at the same offset are fetched
+from the repositories and written back, then the file is checked against the index root checksum.
+<reference index> may be a local, unc network path or http/https url.
+<reference repository list> is the repository list, in JSON or one url per line (see "pcsync repo").
+With --trusted-key, the index must carry a detached signature (see "pcsync sign") by one of the keys.`,
+            Action: Repair,
+            Flags: append([]cli.Flag{
+                regionFlag,
+            }, append(signatureFlags, httpFlags...)...),
+        },
+    )
+}
+
+func Repair(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 3 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", repairUsage)
+    }
+    var (
+        refIndexName  = c.Args()[0]
+        refListName   = c.Args()[1]
+        localFileName = c.Args()[2]
+        startTime     = time.Now()
+    )
+
+    idx, err := loadIndex(c, refIndexName)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+
+    refListReader, err := os.Open(refListName)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    sourceList, err := pcsync.ReadRepositoryList(refListReader)
+    refListReader.Close()
+    if err != nil {
+        return errors.WithStack(err)
+    }
+
+    httpOpts, err := httpOptions(c)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+
+    progress, stopReport := startProgressReport()
+    _, err = pcsync.Repair(
+        context.Background(),
+        pcsync.RepairOptions{
+            Index:        idx,
+            Repositories: sourceList,
+            Region:       c.String("region"),
+            File:         localFileName,
+            Progress:     progress,
+            HTTP:         httpOpts,
+        },
+    )
+    stopReport()
+    if err != nil {
+        return errors.WithStack(err)
+    }
+
+    log.Infof("%v repaired | Time taken: %v", localFileName, time.Now().Sub(startTime))
+    return nil
+}
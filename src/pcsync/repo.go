@@ -1,20 +1,25 @@
 package main
 
 import (
-    "bufio"
-    "encoding/json"
     "os"
     "path/filepath"
 
     log "github.com/Sirupsen/logrus"
     "github.com/pkg/errors"
     "github.com/urfave/cli"
+    "pcsync/pcsync"
 )
 
 const (
     repoUsage string = "Package repository list generation. 'pcsync repo <source list> <list output>'. *use in build script*"
 )
 
+// prefers the repositories of a region, for the commands reading a repository list
+var regionFlag = cli.StringFlag{
+    Name:  "region",
+    Usage: "the region of this host. repositories tagged with it are preferred over the others of the same priority",
+}
+
 func init() {
     app.Commands = append(
         app.Commands,
@@ -22,6 +27,14 @@ func init() {
             Name:      "repo",
             ShortName: "rp",
             Usage:     repoUsage,
+            Description: `Check a repository list and write it in JSON : the array of the urls when no repository sets more than
+its url, as earlier versions wrote lists, and {"repositories": [...]} otherwise.
+<source list> is one url per line, or JSON :
+  {"repositories": [{"url": "https://mirror/image.img", "priority": 0, "weight": 2, "max_concurrency": 4, "timeout": "30s",
+    "region": "us-west", "headers": {"Authorization": "Bearer ${MIRROR_TOKEN}"}}]}
+Repositories are tried by ascending priority, and the requests are shared by weight among the best ones of the first
+priority. Header values expand ${VAR} from the environment when requests are made, so tokens need not be written in the list.
+Only the ${VAR} form is expanded, and a request fails when VAR is not set.`,
             Action:    Repolist,
         },
     )
@@ -51,6 +64,12 @@ func Repolist(c *cli.Context) error {
     }
     defer refListReader.Close()
 
+    // read and check the repository list before touching the output
+    sourceList, err := pcsync.ReadRepositoryList(refListReader)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+
     absOutputPath, err := filepath.Abs(listOut)
     if err != nil {
         handleFileError(absOutputPath, err)
@@ -63,24 +82,11 @@ func Repolist(c *cli.Context) error {
     }
     defer outputFile.Close()
 
-    // read repository list
-    var (
-        scanner  *bufio.Scanner = bufio.NewScanner(refListReader)
-        sourceList []string = nil
-    )
-    for scanner.Scan() {
-        sourceList = append(sourceList, scanner.Text())
-    }
-    err = scanner.Err()
-    if err != nil {
-        return errors.WithStack(err)
-    }
-
-    err = json.NewEncoder(outputFile).Encode(sourceList)
+    err = pcsync.WriteRepositoryList(outputFile, sourceList)
     if err != nil {
         return errors.WithStack(err)
     }
+    log.Infof("%v repositories written to %v", len(sourceList), absOutputPath)
 
     return nil
 }
-
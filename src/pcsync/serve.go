@@ -0,0 +1,105 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "os"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/urfave/cli"
+    "pcsync/pcsync"
+)
+
+const (
+    serveUsage string = "pcsync serve <directory>"
+)
+
+func init() {
+    app.Commands = append(
+        app.Commands,
+        cli.Command{
+            Name:      "serve",
+            Usage:     serveUsage,
+            Description: `Serve a directory of images and their indexes over http, as a repository for patch.
+GET and HEAD requests are answered with Range, If-Range and ETag support. Directories aren't listed, and hidden files
+and the files of a patch in progress aren't served. ` + pcsync.HealthPath + ` answers 200 while the server runs.
+Requests are logged in the combined log format to --access-log.`,
+            Action: Serve,
+            Flags: []cli.Flag{
+                cli.StringFlag{
+                    Name:  "listen",
+                    Value: ":8080",
+                    Usage: "the address to listen on",
+                },
+                cli.StringFlag{
+                    Name:  "access-log",
+                    Value: "-",
+                    Usage: "the access log file, - for stdout. empty to disable",
+                },
+                cli.StringFlag{
+                    Name:  "tls-cert",
+                    Usage: "serve https with this PEM certificate",
+                },
+                cli.StringFlag{
+                    Name:  "tls-key",
+                    Usage: "the PEM key of --tls-cert",
+                },
+            },
+        },
+    )
+}
+
+func Serve(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 1 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", serveUsage)
+    }
+    var (
+        root      = c.Args()[0]
+        listen    = c.String("listen")
+        accessLog io.Writer = nil
+        certFile  = c.String("tls-cert")
+        keyFile   = c.String("tls-key")
+    )
+    if (len(certFile) == 0) != (len(keyFile) == 0) {
+        return errors.New("[ERR] --tls-cert and --tls-key go together")
+    }
+    stat, err := os.Stat(root)
+    if err != nil {
+        handleFileError(root, err)
+        return errors.WithStack(err)
+    }
+    if !stat.IsDir() {
+        return errors.Errorf("[ERR] %v is not a directory", root)
+    }
+
+    switch logName := c.String("access-log"); logName {
+    case "":
+    case "-":
+        accessLog = os.Stdout
+    default:
+        logFile, err := os.OpenFile(logName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+        if err != nil {
+            return errors.WithStack(err)
+        }
+        defer logFile.Close()
+        accessLog = logFile
+    }
+
+    server := &http.Server{
+        Addr:              listen,
+        Handler:           pcsync.NewFileServer(root, accessLog),
+        ReadHeaderTimeout: time.Duration(10) * time.Second,
+        IdleTimeout:       time.Duration(120) * time.Second,
+    }
+    log.Infof("serving %v on %v", root, listen)
+    if len(certFile) != 0 {
+        err = server.ListenAndServeTLS(certFile, keyFile)
+    } else {
+        err = server.ListenAndServe()
+    }
+    return errors.WithStack(err)
+}
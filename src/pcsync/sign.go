@@ -0,0 +1,266 @@
+package main
+
+import (
+    "encoding/base64"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "strings"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/urfave/cli"
+    "golang.org/x/crypto/ed25519"
+    "pcsync/pcsync"
+)
+
+// An index is signed with a detached <index>.sig file. The signature covers the header fields and the root hash, and the
+// root hash covers every block checksum, so a signed header authenticates the whole index and the patched file.
+
+const (
+    keygenUsage string = "gosync keygen <key name>"
+    signUsage   string = "gosync sign --key <private key> <reference index>"
+
+    signatureSuffix  string = ".sig"
+    privateKeySuffix string = ".key"
+    publicKeySuffix  string = ".pub"
+
+    // key and signature files hold a single base64 line
+    maxKeyFileSize int64 = 1024
+)
+
+// flags of the commands that read an index from a repository
+var signatureFlags = []cli.Flag{
+    cli.StringSliceFlag{
+        Name:  "trusted-key",
+        Usage: "A public key file trusted to sign the index. May be repeated. When given, unsigned or badly signed indexes are refused",
+    },
+    cli.StringFlag{
+        Name:  "signature",
+        Usage: "The detached signature of the index. Defaults to <reference index>" + signatureSuffix,
+    },
+}
+
+func init() {
+    app.Commands = append(
+        app.Commands,
+        cli.Command{
+            Name:      "keygen",
+            Usage:     keygenUsage,
+            Description: `Generate an Ed25519 key pair to sign indexes with. The private key is written to <key name>.key and the
+public key, to hand to the nodes with --trusted-key, to <key name>.pub. Existing files are not overwritten.`,
+            Action:    Keygen,
+        },
+        cli.Command{
+            Name:      "sign",
+            Usage:     signUsage,
+            Description: `Check an index and write its detached signature to <reference index>.sig.
+The signature covers the header and the root checksum, which in turn covers every block checksum.`,
+            Action:    Sign,
+            Flags: []cli.Flag{
+                cli.StringFlag{
+                    Name:  "key",
+                    Usage: "The private key file made by keygen",
+                },
+                cli.StringFlag{
+                    Name:  "output",
+                    Usage: "The signature file path. Defaults to <reference index>" + signatureSuffix,
+                },
+            },
+        },
+    )
+}
+
+func Keygen(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 1 || len(c.Args()[0]) == 0 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", keygenUsage)
+    }
+    var (
+        keyName        = c.Args()[0]
+        privateKeyName = keyName + privateKeySuffix
+        publicKeyName  = keyName + publicKeySuffix
+    )
+    publicKey, privateKey, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if err := writeKeyFile(privateKeyName, privateKey, 0600); err != nil {
+        return errors.WithStack(err)
+    }
+    if err := writeKeyFile(publicKeyName, publicKey, 0644); err != nil {
+        os.Remove(privateKeyName)
+        return errors.WithStack(err)
+    }
+    log.Infof("Private key %v | Public key %v", privateKeyName, publicKeyName)
+    fmt.Fprintln(os.Stdout, base64.StdEncoding.EncodeToString(publicKey))
+    return nil
+}
+
+func Sign(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 1 || len(c.String("key")) == 0 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", signUsage)
+    }
+    var (
+        indexName     = c.Args()[0]
+        signatureName = c.String("output")
+    )
+    if len(signatureName) == 0 {
+        signatureName = indexName + signatureSuffix
+    }
+    privateKey, err := readPrivateKey(c.String("key"))
+    if err != nil {
+        return errors.WithStack(err)
+    }
+
+    indexFile := openFileAndHandleError(indexName)
+    if indexFile == nil {
+        return errors.Errorf("unable to open reference index %v", indexName)
+    }
+    defer indexFile.Close()
+    // don't vouch for an index whose checksums don't add up to its root hash
+    idx, err := pcsync.ReadIndex(indexFile)
+    if err != nil {
+        return errors.WithMessage(err, "Error loading index")
+    }
+
+    signature, err := pcsync.SignIndex(idx.Header(), privateKey)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if err := ioutil.WriteFile(signatureName, []byte(base64.StdEncoding.EncodeToString(signature) + "\n"), 0644); err != nil {
+        return errors.WithStack(err)
+    }
+    log.Infof("Signed %v with the key of %v | Signature %v", indexName, base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)), signatureName)
+    return nil
+}
+
+// checks the index signature when the command is given trusted keys. without trusted keys, any index is accepted.
+func checkIndexSignature(c *cli.Context, indexName string, header *pcsync.Header) error {
+    trustedKeys, err := readTrustedKeys(c)
+    if err != nil || len(trustedKeys) == 0 {
+        return err
+    }
+    signatureName := c.String("signature")
+    if len(signatureName) == 0 {
+        signatureName = signaturePath(indexName)
+    }
+    signature, err := readSignature(c, signatureName)
+    if err != nil {
+        return err
+    }
+    return verifyTrustedSignature(indexName, header, signature, trustedKeys)
+}
+
+// checks the signature carried in a bundle, or the one given with --signature, when the command is given trusted keys
+func checkBundleSignature(c *cli.Context, bundle *pcsync.Bundle) error {
+    trustedKeys, err := readTrustedKeys(c)
+    if err != nil || len(trustedKeys) == 0 {
+        return err
+    }
+    signature := bundle.Signature()
+    if signatureName := c.String("signature"); len(signatureName) != 0 {
+        if signature, err = readSignature(c, signatureName); err != nil {
+            return err
+        }
+    }
+    if signature == nil {
+        return errors.Errorf("[ERR] the index of %v is not signed", bundle.Name())
+    }
+    return verifyTrustedSignature(bundle.Name(), bundle.Index().Header(), signature, trustedKeys)
+}
+
+func readTrustedKeys(c *cli.Context) ([]ed25519.PublicKey, error) {
+    var trustedKeys []ed25519.PublicKey = nil
+    for _, name := range c.StringSlice("trusted-key") {
+        key, err := readPublicKey(name)
+        if err != nil {
+            return nil, errors.WithStack(err)
+        }
+        trustedKeys = append(trustedKeys, key)
+    }
+    return trustedKeys, nil
+}
+
+func readSignature(c *cli.Context, signatureName string) ([]byte, error) {
+    signatureReader, err := getLocalOrRemoteFile(c, signatureName)
+    if err != nil {
+        return nil, errors.WithMessage(err, "the index is not signed. unable to read signature " + signatureName)
+    }
+    defer signatureReader.Close()
+    signature, err := readKeyFile(signatureReader, signatureName, ed25519.SignatureSize)
+    return signature, errors.WithStack(err)
+}
+
+func verifyTrustedSignature(indexName string, header *pcsync.Header, signature []byte, trustedKeys []ed25519.PublicKey) error {
+    key, err := pcsync.VerifyIndexSignature(header, signature, trustedKeys)
+    if err != nil {
+        return errors.Errorf("[ERR] %v is not signed by a trusted key", indexName)
+    }
+    log.Infof("Index signed by trusted key %v", base64.StdEncoding.EncodeToString(key))
+    return nil
+}
+
+// returns the path of the detached signature of an index. for urls, the suffix goes to the path, before the query.
+func signaturePath(indexName string) string {
+    u, err := url.Parse(indexName)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+        return indexName + signatureSuffix
+    }
+    u.Path += signatureSuffix
+    u.RawPath = ""
+    return u.String()
+}
+
+func writeKeyFile(path string, key []byte, perm os.FileMode) error {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+        f.Close()
+        return errors.WithStack(err)
+    }
+    return errors.WithStack(f.Close())
+}
+
+// reads a base64 line of exactly 'size' bytes
+func readKeyFile(r io.Reader, path string, size int) ([]byte, error) {
+    data, err := ioutil.ReadAll(io.LimitReader(r, maxKeyFileSize))
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil {
+        return nil, errors.WithMessage(err, "invalid key or signature file " + path)
+    }
+    if len(key) != size {
+        return nil, errors.Errorf("invalid key or signature file %v : %v bytes, expected %v", path, len(key), size)
+    }
+    return key, nil
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer f.Close()
+    key, err := readKeyFile(f, path, ed25519.PublicKeySize)
+    return ed25519.PublicKey(key), err
+}
+
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, errors.WithStack(err)
+    }
+    defer f.Close()
+    key, err := readKeyFile(f, path, ed25519.PrivateKeySize)
+    return ed25519.PrivateKey(key), err
+}
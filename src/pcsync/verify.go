@@ -0,0 +1,81 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "time"
+
+    log "github.com/Sirupsen/logrus"
+    "github.com/pkg/errors"
+    "github.com/urfave/cli"
+    "pcsync/pcsync"
+)
+
+const (
+    verifyUsage string = "gosync verify <local file> <reference index>"
+)
+
+func init() {
+    app.Commands = append(
+        app.Commands,
+        cli.Command{
+            Name:      "verify",
+            ShortName: "v",
+            Usage:     verifyUsage,
+            Description: `Check a local file against an index, block by block at the same offsets, and print the block ranges that differ.
+Unlike diff, blocks are not searched for elsewhere in the file, so corrupted blocks (e.g. from bit rot) are reported.
+Exits with an error when any block or the root checksum differs.
+<reference index> may be a local, unc network path or http/https url.
+With --trusted-key, the index must carry a detached signature (see "pcsync sign") by one of the keys.`,
+            Action: Verify,
+            Flags:  append(signatureFlags, httpFlags...),
+        },
+    )
+}
+
+func Verify(c *cli.Context) error {
+    log.SetLevel(log.DebugLevel)
+
+    if len(c.Args()) < 2 {
+        return errors.Errorf("Usage is \"%v\" (invalid number of arguments)", verifyUsage)
+    }
+    var (
+        localFilename = c.Args()[0]
+        indexName     = c.Args()[1]
+        startTime     = time.Now()
+    )
+
+    localFile := openFileAndHandleError(localFilename)
+    if localFile == nil {
+        return errors.Errorf("unable to open local file %v", localFilename)
+    }
+    defer localFile.Close()
+
+    idx, err := loadIndex(c, indexName)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    result, err := pcsync.Verify(context.Background(), localFile, idx)
+    if err != nil {
+        return errors.WithStack(err)
+    }
+    fi, err := localFile.Stat()
+    if err != nil {
+        return errors.WithMessage(err, "Could not get info on file:")
+    }
+
+    header := idx.Header()
+    for _, r := range result.Mismatching {
+        fmt.Fprintf(os.Stdout, "mismatching blocks %v-%v (bytes %v-%v)\n", r.StartBlock, r.EndBlock, r.Start, r.End - 1)
+    }
+    if fi.Size() != header.FileSize {
+        fmt.Fprintf(os.Stdout, "mismatching file size %v, expected %v\n", fi.Size(), header.FileSize)
+    }
+    log.Infof("Blocks: %v | Mismatching blocks: %v | Root checksum match: %v | Time taken: %v", header.BlockCount, result.MismatchingBlocks, result.RootHashMatch, time.Now().Sub(startTime))
+
+    if result.MismatchingBlocks != 0 || !result.RootHashMatch || fi.Size() != header.FileSize {
+        return errors.Errorf("%v does not match %v", localFilename, indexName)
+    }
+    return nil
+}